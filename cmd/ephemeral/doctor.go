@@ -0,0 +1,45 @@
+package main
+
+import (
+	"ephemeral/internal/discovery"
+	"ephemeral/internal/doctor"
+	"ephemeral/internal/netutil"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runDoctor checks what LAN chat needs from this machine and network and
+// prints what to do about anything that failed. It exits 1 if a check
+// failed outright.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	port := fs.Int("port", 9999, "TCP port the chat would listen on")
+	ifaces := fs.String("interface", "", "Comma-separated network interfaces to check (default all)")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each probe to come back")
+	fs.Parse(args)
+
+	var names []string
+	if *ifaces != "" {
+		names = strings.Split(*ifaces, ",")
+	}
+	scope, err := netutil.NewScope(nil, names)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	status := exitOK
+	for _, f := range doctor.Run(doctor.Options{Scope: scope, Port: *port, UDPPort: discovery.UDPBroadcastPort, Timeout: *timeout}) {
+		fmt.Printf("[%-4s] %s: %s\n", f.Status, f.Check, f.Detail)
+		if f.Fix != "" {
+			fmt.Printf("       -> %s\n", f.Fix)
+		}
+		if f.Status == doctor.Fail {
+			status = exitError
+		}
+	}
+	return status
+}
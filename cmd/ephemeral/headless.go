@@ -0,0 +1,25 @@
+package main
+
+import (
+	"ephemeral/internal/control"
+	"ephemeral/internal/node"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runHeadless drives n from stdin and reports to stdout, both as control
+// API JSON lines, with every event streamed from the start. Logs go to
+// stderr. Events keep coming after stdin is closed, so it also runs as a
+// daemon with no input; a signal stops it.
+func runHeadless(n *node.Node) {
+	api := control.New(n)
+	defer api.Close()
+	go api.Serve(os.Stdin, os.Stdout, true)
+
+	log.Printf("Running headless as %s (%s)", n.Rooms.Nick(), n.Rooms.PeerID)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"ephemeral/internal/control"
+	"ephemeral/internal/node"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runListen prints the messages of a room as they arrive, starting with
+// whatever backlog its members send, until interrupted.
+func runListen(args []string) int {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	nf := addNodeFlags(fs, "ephemeral-listen", 0)
+	roomName := fs.String("room", "global", "Room to listen to")
+	password := fs.String("password", "", "Password of an encrypted room")
+	asJSON := fs.Bool("json", false, "Print each message as a JSON line")
+	fs.Parse(args)
+
+	cfg, err := nf.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{oneShot: true}, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer stop()
+	events, cancel := n.Subscribe()
+	defer cancel()
+	if err := n.Join(*roomName, *password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind != node.Message || ev.Message.Room != *roomName || ev.Message.From == n.Rooms.PeerID {
+				continue
+			}
+			if *asJSON {
+				enc.Encode(control.NewMessage(ev.Message, n.Rooms.PeerID))
+			} else {
+				fmt.Printf("%s %s: %s\n", time.Unix(ev.Message.TS, 0).Format("15:04"), ev.Message.Nick, ev.Message.Payload)
+			}
+		case <-sig:
+			return exitOK
+		}
+	}
+}
@@ -1,25 +1,46 @@
 package main
 
 import (
-	"ephemeral/internal/config"
-	"ephemeral/internal/discovery"
-	"ephemeral/internal/room"
+	"ephemeral/internal/protocol"
 	"ephemeral/internal/transport"
 	"ephemeral/internal/tui"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/google/uuid"
 )
 
 const version = "1.0.0"
 
 func main() {
-	nick := flag.String("nick", "guest", "Your nickname")
-	port := flag.Int("port", 9999, "Port to listen on (0 for random)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "relay":
+			runRelay(os.Args[2:])
+			return
+		case "web":
+			runWeb(os.Args[2:])
+			return
+		case "send":
+			os.Exit(runSend(os.Args[2:]))
+		case "listen":
+			os.Exit(runListen(os.Args[2:]))
+		case "peers":
+			os.Exit(runPeers(os.Args[2:]))
+		case "pipe":
+			os.Exit(runPipe(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
+
+	nf := addNodeFlags(flag.CommandLine, "guest", 9999)
+	nf.services = true
+	headless := flag.Bool("headless", false, "Run without the terminal UI, reading commands from stdin and writing events to stdout as JSON lines")
 	v := flag.Bool("version", false, "Show version information")
 	flag.Parse()
 
@@ -28,29 +49,28 @@ func main() {
 		os.Exit(0)
 	}
 
-	cfg := config.Default()
-	cfg.Nick = *nick
-	cfg.Port = *port
-
-	peerID := uuid.New().String()
-
-	tr := transport.New(cfg.Port, peerID, cfg.Nick)
-	if err := tr.Start(); err != nil {
-		log.Fatalf("Failed to start transport: %v", err)
+	cfg, err := nf.config()
+	if err != nil {
+		log.Fatal(err)
 	}
-	defer tr.Stop()
-	
-	cfg.Port = tr.Port
-	
-	disc := discovery.NewService(cfg.Nick, peerID, cfg.Port, true, true)
-	if err := disc.Start(); err != nil {
-		log.Fatalf("Failed to start discovery: %v", err)
+	// The terminal belongs to the TUI, so its logs only go to the log file
+	// if ephemeral_logs is off.
+	console := io.Discard
+	if *headless {
+		console = os.Stderr
 	}
-	defer disc.Stop()
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{transfers: !*headless}, console)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
 
-	rm := room.NewManager(cfg.Nick, peerID)
+	if *headless {
+		runHeadless(n)
+		return
+	}
 
-	model := tui.InitialModel(cfg, rm, tr, disc)
+	model := tui.InitialModel(cfg, n)
 	p := tea.NewProgram(model, tea.WithAltScreen())
 
 	if _, err := p.Run(); err != nil {
@@ -58,3 +78,32 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// offeredCodecs turns the configured codec into a handshake offer. JSON is
+// always offered last so peers without the preferred codec still connect.
+func offeredCodecs(name string) ([]string, error) {
+	if _, ok := protocol.CodecByName(name); !ok {
+		return nil, fmt.Errorf("unknown codec %q (want json or binary)", name)
+	}
+	if name == protocol.CodecJSON {
+		return []string{protocol.CodecJSON}, nil
+	}
+	return []string{name, protocol.CodecJSON}, nil
+}
+
+// dialUnixSiblings links up with every other instance whose socket lives in
+// the same directory as ours.
+func dialUnixSiblings(tr transport.Transport, self string) {
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(self), "*"))
+	for _, path := range matches {
+		if path == self {
+			continue
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		if err := tr.Dial("", path); err != nil {
+			log.Printf("Failed to reach %s: %v", path, err)
+		}
+	}
+}
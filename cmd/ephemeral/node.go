@@ -0,0 +1,277 @@
+package main
+
+import (
+	"ephemeral/internal/bot"
+	"ephemeral/internal/config"
+	"ephemeral/internal/control"
+	"ephemeral/internal/discovery"
+	"ephemeral/internal/logging"
+	"ephemeral/internal/netutil"
+	"ephemeral/internal/node"
+	"ephemeral/internal/overlay"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transfer"
+	"ephemeral/internal/transport"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// nodeFlags are the flags shared by every command that runs a chat node.
+type nodeFlags struct {
+	fs          *flag.FlagSet
+	defaults    config.Config
+	configPath  *string
+	nick        *string
+	port        *int
+	overlayMode *string
+	codec       *string
+	compress    *bool
+	listen      *string
+	ifaces      *string
+	unixSock    *string
+	control     *string
+	peers       []string
+	// services is set by the TUI and headless mode, the only commands that
+	// run the configured control API and bots.
+	services bool
+}
+
+// addNodeFlags registers the node flags on fs with the given defaults.
+// One-shot commands default to port 0 so they run beside an interactive
+// instance.
+func addNodeFlags(fs *flag.FlagSet, nick string, port int) *nodeFlags {
+	f := &nodeFlags{
+		fs:          fs,
+		defaults:    *config.Default(),
+		configPath:  fs.String("config", "", "YAML config `file` (default $EPHEMERAL_CONFIG, else "+config.DefaultPath()+" if it exists)"),
+		nick:        fs.String("nick", nick, "Your nickname"),
+		port:        fs.Int("port", port, "Port to listen on (0 for random)"),
+		overlayMode: fs.String("overlay", "auto", "Message dissemination: mesh, gossip or auto"),
+		codec:       fs.String("codec", "json", "Wire codec to offer peers: json or binary"),
+		compress:    fs.Bool("compress", true, "Compress large payloads for peers that accept it"),
+		listen:      fs.String("listen", "", "Comma-separated IP addresses to listen on and advertise (default all)"),
+		ifaces:      fs.String("interface", "", "Comma-separated network interfaces to use for the transport and discovery (default all)"),
+		unixSock:    fs.String("unix", "", "Listen on a Unix socket instead of TCP, linking only with instances in the same directory"),
+		control:     fs.String("control", "", "Serve the JSON-lines control API for scripts on this Unix socket `path`"),
+	}
+	fs.Func("peer", "Static peer `host:port` to connect to and keep connected (repeatable)", func(addr string) error {
+		f.peers = append(f.peers, addr)
+		return nil
+	})
+	f.defaults.Nick, f.defaults.Port = nick, port
+	return f
+}
+
+// config builds the configuration from, in increasing precedence, the
+// defaults, the config file, EPHEMERAL_* environment variables and the
+// flags given on the command line. A default port of 0 is kept unless
+// --port is given, so one-shot commands never take the configured port
+// from an interactive instance. Other commands than the TUI and headless
+// mode also leave out the configured control socket and bots, which belong
+// to the instance the config is for; --control still applies.
+func (f *nodeFlags) config() (*config.Config, error) {
+	set := make(map[string]bool)
+	f.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	cfg := f.defaults
+	path, explicit := *f.configPath, true
+	if path == "" {
+		path, explicit = os.Getenv(config.EnvPrefix+"CONFIG"), true
+	}
+	if path == "" {
+		path, explicit = config.DefaultPath(), false
+	}
+	if path != "" {
+		if err := cfg.ReadFile(path); err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if f.defaults.Port == 0 {
+		cfg.Port = 0
+	}
+	if !f.services {
+		cfg.Control, cfg.Bots = "", nil
+	}
+
+	if set["nick"] {
+		cfg.Nick = *f.nick
+	}
+	if set["port"] {
+		cfg.Port = *f.port
+	}
+	if set["overlay"] {
+		cfg.Overlay.Mode = *f.overlayMode
+	}
+	if set["codec"] {
+		cfg.Codec = *f.codec
+	}
+	if set["compress"] {
+		cfg.Compress = *f.compress
+	}
+	if set["listen"] {
+		cfg.Listen = splitList(*f.listen)
+	}
+	if set["interface"] {
+		cfg.Interfaces = splitList(*f.ifaces)
+	}
+	if set["control"] {
+		cfg.Control = *f.control
+	}
+	cfg.Peers = append(cfg.Peers, f.peers...)
+	return &cfg, cfg.Validate()
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// nodeOptions say what kind of session a command runs.
+type nodeOptions struct {
+	// transfers sets up file transfers, for a front end that can answer
+	// offers; without one, offers are declined.
+	transfers bool
+	// oneShot leaves without a leave announcement, so a script's send or
+	// pipe does not put "<nick> left" in every room it was in.
+	oneShot bool
+}
+
+// startNode brings up the transport, discovery and a node for cfg,
+// listening on unixSock instead of TCP if it is set, and joins the
+// configured rooms. Logs go to console as configured. stop shuts them all
+// down again.
+func startNode(cfg *config.Config, unixSock string, opts nodeOptions, console io.Writer) (*node.Node, func(), error) {
+	closeLog, err := logging.Setup(cfg.Logging, console)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid logging settings: %w", err)
+	}
+	n, stopServices, err := startServices(cfg, unixSock, opts)
+	if err != nil {
+		closeLog()
+		return nil, nil, err
+	}
+	return n, func() { stopServices(); closeLog() }, nil
+}
+
+func startServices(cfg *config.Config, unixSock string, opts nodeOptions) (n *node.Node, stop func(), err error) {
+	scope, err := netutil.NewScope(cfg.Listen, cfg.Interfaces)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid network selection: %w", err)
+	}
+	if !scope.All() && len(scope.Addrs()) == 0 {
+		return nil, nil, fmt.Errorf("no usable address on %s", strings.Join(cfg.Interfaces, ", "))
+	}
+
+	peerID := uuid.New().String()
+
+	codecs, err := offeredCodecs(cfg.Codec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rm := room.NewManager(cfg.Nick, peerID)
+
+	var mesh *transport.Mesh
+	if unixSock != "" {
+		mesh = transport.NewUnix(unixSock, peerID, cfg.Nick)
+		cfg.Discovery.MDNS = false
+		cfg.Discovery.UDPFallback = false
+	} else {
+		mesh = transport.NewTCPOn(scope.ListenAddrs(cfg.Port), peerID, cfg.Nick)
+	}
+	mesh.Codecs = codecs
+	mesh.Clock = rm.Clock
+	mesh.Compress = cfg.Compress
+	mesh.MaxInbound = cfg.Limits.MaxInbound
+	mesh.MaxOutbound = cfg.Limits.MaxOutbound
+	mesh.MaxPerIP = cfg.Limits.MaxPerIP
+	mesh.HandshakeTimeout = cfg.Limits.HandshakeTimeout
+	mesh.Quiet = opts.oneShot
+	var tr transport.Transport = mesh
+	if mode := overlay.Mode(cfg.Overlay.Mode); mode != overlay.ModeMesh {
+		ocfg := overlay.DefaultConfig()
+		ocfg.Mode = mode
+		ocfg.ActiveSize = cfg.Overlay.ActiveSize
+		ocfg.MeshThreshold = cfg.Overlay.MeshThreshold
+		tr = overlay.New(tr, peerID, cfg.Nick, ocfg)
+	}
+	if err := tr.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start transport: %w", err)
+	}
+
+	if unixSock != "" {
+		go dialUnixSiblings(tr, unixSock)
+	} else {
+		cfg.Port = transport.Port(tr)
+	}
+	for _, addr := range cfg.Peers {
+		tr.Persist(addr)
+	}
+
+	disc := discovery.NewService(cfg.Nick, peerID, cfg.Port, cfg.Discovery.MDNS, cfg.Discovery.UDPFallback)
+	disc.Scope = scope
+	if err := disc.Start(); err != nil {
+		tr.Stop()
+		return nil, nil, fmt.Errorf("failed to start discovery: %w", err)
+	}
+
+	var xfer *transfer.Manager
+	if opts.transfers {
+		xfer = transfer.New(tr, rm)
+		if cfg.Downloads != "" {
+			xfer.Dir = cfg.Downloads
+		}
+	}
+
+	n = node.New(rm, tr, disc, xfer)
+	n.Start()
+
+	api := control.New(n)
+	bots := bot.New(n)
+	stop = func() {
+		bots.Stop()
+		api.Close()
+		n.Stop()
+		if xfer != nil {
+			xfer.Close()
+		}
+		disc.Stop()
+		tr.Stop()
+	}
+	if cfg.Control != "" {
+		if err := api.Listen(cfg.Control); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("failed to serve control API: %w", err)
+		}
+	}
+	for _, r := range cfg.Rooms {
+		if err := n.Join(r.Name, r.Password); err != nil {
+			stop()
+			return nil, nil, err
+		}
+	}
+	for _, c := range cfg.Bots {
+		h, err := bot.FromConfig(c)
+		if err == nil {
+			err = bots.Add(h)
+		}
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+	}
+	bots.Start()
+	return n, stop, nil
+}
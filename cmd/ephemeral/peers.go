@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"ephemeral/internal/transport"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type peerRow struct {
+	Nick      string   `json:"nick"`
+	ID        string   `json:"id"`
+	Addrs     []string `json:"addrs"`
+	Connected bool     `json:"connected"`
+	RTTMs     float64  `json:"rtt_ms,omitempty"`
+}
+
+// runPeers runs discovery for a while and prints who it found, pinging
+// those it could connect to. It exits 2 if nobody was found.
+func runPeers(args []string) int {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	nf := addNodeFlags(fs, "ephemeral-peers", 0)
+	wait := fs.Duration("wait", 3*time.Second, "How long to run discovery")
+	asJSON := fs.Bool("json", false, "Print the peers as a JSON array")
+	fs.Parse(args)
+
+	cfg, err := nf.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{oneShot: true}, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer stop()
+
+	time.Sleep(*wait)
+	for _, p := range n.Transport.Peers() {
+		n.Transport.Ping(p.ID)
+	}
+	time.Sleep(settleWindow)
+
+	linked := make(map[string]transport.PeerInfo)
+	for _, p := range n.Transport.Peers() {
+		linked[p.ID] = p
+	}
+	var rows []peerRow
+	for _, p := range n.Discovery.Known() {
+		row := peerRow{Nick: p.Nick, ID: p.ID, Addrs: p.DialAddrs()}
+		if info, ok := linked[p.ID]; ok {
+			row.Connected = true
+			row.RTTMs = float64(info.RTT.Microseconds()) / 1000
+			delete(linked, p.ID)
+		}
+		rows = append(rows, row)
+	}
+	// Static and Unix-socket peers are linked without being discovered.
+	for _, info := range linked {
+		rows = append(rows, peerRow{Nick: info.Nick, ID: info.ID, Addrs: []string{info.Addr}, Connected: true, RTTMs: float64(info.RTT.Microseconds()) / 1000})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Nick < rows[j].Nick })
+
+	if *asJSON {
+		if rows == nil {
+			rows = []peerRow{}
+		}
+		json.NewEncoder(os.Stdout).Encode(rows)
+	} else if len(rows) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NICK\tID\tADDRESSES\tRTT")
+		for _, r := range rows {
+			rtt := "-"
+			if r.Connected && r.RTTMs > 0 {
+				rtt = fmt.Sprintf("%.1fms", r.RTTMs)
+			} else if r.Connected {
+				rtt = "connected"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Nick, shortID(r.ID), strings.Join(r.Addrs, ","), rtt)
+		}
+		tw.Flush()
+	}
+	if len(rows) == 0 {
+		fmt.Fprintf(os.Stderr, "No peers found within %s\n", *wait)
+		return exitNoPeers
+	}
+	return exitOK
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"ephemeral/internal/pipe"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runPipe posts stdin to a room line by line, coalesced and rate-limited,
+// and exits once stdin ends and the last post is acknowledged (or --wait
+// passes). Lines go out even with nobody listening yet: members who join
+// while it runs get them in their backlog.
+func runPipe(args []string) int {
+	fs := flag.NewFlagSet("pipe", flag.ExitOnError)
+	nf := addNodeFlags(fs, "ephemeral-pipe", 0)
+	roomName := fs.String("room", "global", "Room to post in")
+	password := fs.String("password", "", "Password of an encrypted room")
+	interval := fs.Duration("interval", pipe.DefaultInterval, "Least time between posts; lines read meanwhile are joined into one")
+	maxBytes := fs.Int("max-bytes", pipe.DefaultMaxBytes, "Largest post in bytes; longer lines are split")
+	wait := fs.Duration("wait", 5*time.Second, "How long to look for peers first, and to wait for the last post to be acknowledged")
+	fs.Parse(args)
+
+	cfg, err := nf.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{oneShot: true}, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer stop()
+	if err := n.Join(*roomName, *password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	if !waitUntil(time.Now().Add(*wait), func() bool { return len(members(n, *roomName)) > 0 }) {
+		fmt.Fprintf(os.Stderr, "No peer in %s yet; posting anyway\n", *roomName)
+	}
+
+	var lastID string
+	p := pipe.New(func(text string) error {
+		env, err := n.Say(*roomName, text)
+		lastID = env.ID
+		return err
+	})
+	p.Interval = *interval
+	p.MaxBytes = *maxBytes
+	if err := p.Run(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	if lastID != "" && !waitUntil(time.Now().Add(*wait), func() bool {
+		// Untracked means it went to nobody, so there is nothing to wait for.
+		st, ok := n.Transport.Delivery(lastID)
+		return !ok || st.Pending == 0
+	}) {
+		fmt.Fprintf(os.Stderr, "Some peers in %s did not acknowledge the last lines\n", *roomName)
+		return exitUnacked
+	}
+	return exitOK
+}
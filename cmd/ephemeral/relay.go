@@ -0,0 +1,109 @@
+package main
+
+import (
+	"ephemeral/internal/discovery"
+	"ephemeral/internal/netutil"
+	"ephemeral/internal/relay"
+	"ephemeral/internal/transport"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// runRelay runs a headless node that forwards room traffic between peers
+// registered with it, e.g. `ephemeral --peer relay.example:9999` on each
+// side of a VLAN split.
+func runRelay(args []string) {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	nick := fs.String("nick", "relay", "Name shown to peers")
+	port := fs.Int("port", 9999, "Port to listen on")
+	listen := fs.String("listen", "", "Comma-separated IP addresses to listen on and advertise (default all)")
+	ifaces := fs.String("interface", "", "Comma-separated network interfaces to use (default all)")
+	codec := fs.String("codec", "binary", "Wire codec to offer peers: json or binary")
+	maxInbound := fs.Int("max-inbound", 512, "Most inbound connections to hold (0 for no limit)")
+	maxPerIP := fs.Int("max-per-ip", transport.DefaultMaxPerIP, "Most inbound connections from one address (0 for no limit)")
+	discover := fs.Bool("discovery", true, "Also discover and link with peers on the local network")
+	var peers []string
+	fs.Func("peer", "Other relay or peer `host:port` to keep connected (repeatable)", func(addr string) error {
+		peers = append(peers, addr)
+		return nil
+	})
+	fs.Parse(args)
+
+	var listenAddrs, ifaceNames []string
+	if *listen != "" {
+		listenAddrs = strings.Split(*listen, ",")
+	}
+	if *ifaces != "" {
+		ifaceNames = strings.Split(*ifaces, ",")
+	}
+	scope, err := netutil.NewScope(listenAddrs, ifaceNames)
+	if err != nil {
+		log.Fatalf("Invalid network selection: %v", err)
+	}
+
+	codecs, err := offeredCodecs(*codec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	peerID := uuid.New().String()
+	tr := transport.NewTCPOn(scope.ListenAddrs(*port), peerID, *nick)
+	tr.Codecs = codecs
+	tr.MaxInbound = *maxInbound
+	tr.MaxPerIP = *maxPerIP
+	if err := tr.Start(); err != nil {
+		log.Fatalf("Failed to start transport: %v", err)
+	}
+	defer tr.Stop()
+	for _, addr := range peers {
+		tr.Persist(addr)
+	}
+
+	r := relay.New(tr)
+	r.Start()
+	defer r.Stop()
+
+	if *discover {
+		disc := discovery.NewService(*nick, peerID, transport.Port(tr), true, true)
+		disc.Scope = scope
+		if err := disc.Start(); err != nil {
+			log.Fatalf("Failed to start discovery: %v", err)
+		}
+		defer disc.Stop()
+		go func() {
+			for p := range disc.Peers() {
+				go tr.Dial(p.ID, p.DialAddrs()...)
+			}
+		}()
+	}
+
+	go reportAdmission(tr)
+
+	log.Printf("Relay %s listening on %s", *nick, tr.Addr())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
+
+// reportAdmission logs connection counts each minute in which the relay
+// turned connections away.
+func reportAdmission(tr *transport.Mesh) {
+	var last transport.AdmissionStats
+	for range time.Tick(time.Minute) {
+		st := tr.Admission()
+		rejected := st.RejectedInbound + st.RejectedPerIP + st.RejectedOutbound + st.HandshakeTimeouts
+		if rejected == last.RejectedInbound+last.RejectedPerIP+last.RejectedOutbound+last.HandshakeTimeouts {
+			continue
+		}
+		log.Printf("Connections: %d in, %d out; rejected %d over limit, %d per-IP, %d outbound, %d handshake timeouts",
+			st.Inbound, st.Outbound, st.RejectedInbound, st.RejectedPerIP, st.RejectedOutbound, st.HandshakeTimeouts)
+		last = st
+	}
+}
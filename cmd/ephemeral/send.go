@@ -0,0 +1,111 @@
+package main
+
+import (
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Exit statuses of the one-shot commands.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitNoPeers = 2
+	exitUnacked = 3
+)
+
+// settleWindow is how long to wait for more peers, or pongs, once the
+// first has turned up.
+const settleWindow = 500 * time.Millisecond
+
+// runSend posts one message to a room and exits once every neighbour it was
+// handed to has acknowledged it: 0 when delivered, 2 if no member of the
+// room was found, 3 if some did not acknowledge in time, 1 on other
+// errors. Acks are hop by hop, so behind a relay 0 only means the relay
+// has it.
+func runSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ephemeral send [flags] message...")
+		fs.PrintDefaults()
+	}
+	nf := addNodeFlags(fs, "ephemeral-send", 0)
+	roomName := fs.String("room", "global", "Room to post in")
+	password := fs.String("password", "", "Password of an encrypted room")
+	wait := fs.Duration("wait", 5*time.Second, "How long to look for peers and wait for delivery")
+	fs.Parse(args)
+
+	text := strings.Join(fs.Args(), " ")
+	if text == "" {
+		fs.Usage()
+		return exitError
+	}
+
+	cfg, err := nf.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{oneShot: true}, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer stop()
+	if err := n.Join(*roomName, *password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	deadline := time.Now().Add(*wait)
+	if !waitUntil(deadline, func() bool { return len(members(n, *roomName)) > 0 }) {
+		fmt.Fprintf(os.Stderr, "No peer in %s found within %s\n", *roomName, *wait)
+		return exitNoPeers
+	}
+	// Peers discovered together link within moments of each other.
+	time.Sleep(min(settleWindow, time.Until(deadline)))
+
+	env, err := n.Say(*roomName, text)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	delivered := waitUntil(deadline, func() bool {
+		st, ok := n.Transport.Delivery(env.ID)
+		return ok && st.Pending == 0
+	})
+	st, _ := n.Transport.Delivery(env.ID)
+	if !delivered {
+		fmt.Fprintf(os.Stderr, "Sent to %s; %d of %d peers acknowledged\n", *roomName, st.Acked, st.Acked+st.Pending)
+		return exitUnacked
+	}
+	fmt.Fprintf(os.Stderr, "Delivered to %d peers in %s\n", st.Acked, *roomName)
+	return exitOK
+}
+
+// members lists the connected peers subscribed to roomName.
+func members(n *node.Node, roomName string) []string {
+	var ids []string
+	for _, p := range n.Transport.Peers() {
+		if slices.Contains(p.Rooms, roomName) || slices.Contains(p.Rooms, protocol.AllRooms) {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
+// waitUntil polls cond until it holds or deadline passes.
+func waitUntil(deadline time.Time, cond func() bool) bool {
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
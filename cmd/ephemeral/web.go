@@ -0,0 +1,56 @@
+package main
+
+import (
+	"ephemeral/internal/web"
+	"ephemeral/website"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runWeb runs a node without the TUI and serves the bundled web client on
+// a loopback address, so a browser on this machine can chat through it.
+func runWeb(args []string) {
+	fs := flag.NewFlagSet("web", flag.ExitOnError)
+	nf := addNodeFlags(fs, "guest", 9999)
+	addr := fs.String("http", "127.0.0.1:8080", "Loopback `address` to serve the web client on")
+	fs.Parse(args)
+
+	// The gateway chats as this node with no login, so it must not be
+	// reachable from other machines.
+	if !web.IsLoopback(*addr) {
+		log.Fatalf("Refusing to serve on %s: the web client is only available on loopback addresses", *addr)
+	}
+
+	cfg, err := nf.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, stop, err := startNode(cfg, *nf.unixSock, nodeOptions{}, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("Failed to serve web client: %v", err)
+	}
+	srv := &http.Server{Handler: web.New(n, website.FS)}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Web client stopped: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	log.Printf("Chatting as %s; open http://%s%s", cfg.Nick, ln.Addr(), web.Page)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
@@ -0,0 +1,211 @@
+package bot
+
+import (
+	"context"
+	"ephemeral/internal/config"
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds a hook that sets no timeout of its own.
+	DefaultTimeout = 10 * time.Second
+	// MaxReply caps what a hook may post in answer to one message.
+	MaxReply = 4096
+	// maxRunning is how many hook invocations may run at once; messages
+	// arriving while all slots are busy are not handed to hooks.
+	maxRunning = 4
+)
+
+// Handler reacts to a chat message. It returns the lines to post back to
+// the message's room, if any, and must give up once ctx is done.
+type Handler interface {
+	Handle(ctx context.Context, env protocol.Envelope) ([]string, error)
+}
+
+type HandlerFunc func(ctx context.Context, env protocol.Envelope) ([]string, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, env protocol.Envelope) ([]string, error) {
+	return f(ctx, env)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Handler{}
+)
+
+// Register makes a Go handler available to bots configured with
+// `handler: name`. Call it from an init function.
+func Register(name string, h Handler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = h
+}
+
+func lookup(name string) (Handler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	h, ok := registry[name]
+	return h, ok
+}
+
+// Hook hands messages to a Handler: messages in Rooms (any joined room if
+// empty) whose text matches Match (everything if nil).
+type Hook struct {
+	Name    string
+	Rooms   []string
+	Match   *regexp.Regexp
+	Timeout time.Duration
+	Handler Handler
+}
+
+func (h *Hook) wants(env protocol.Envelope) bool {
+	if len(h.Rooms) > 0 && !slices.Contains(h.Rooms, env.Room) {
+		return false
+	}
+	return h.Match == nil || h.Match.MatchString(env.Payload)
+}
+
+// FromConfig builds the hook a bot entry describes: an executable when
+// Command is set, otherwise the registered Go handler named Handler.
+func FromConfig(c config.BotConfig) (Hook, error) {
+	h := Hook{Name: c.Name, Rooms: c.Rooms, Timeout: c.Timeout}
+	if c.Match != "" {
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return h, fmt.Errorf("bot %s: invalid match: %w", c.Name, err)
+		}
+		h.Match = re
+	}
+	switch {
+	case len(c.Command) > 0 && c.Handler != "":
+		return h, fmt.Errorf("bot %s: set command or handler, not both", c.Name)
+	case len(c.Command) > 0:
+		h.Handler = &Exec{Command: c.Command, Env: c.Env, Dir: c.Dir}
+	case c.Handler != "":
+		handler, ok := lookup(c.Handler)
+		if !ok {
+			return h, fmt.Errorf("bot %s: no handler registered as %q", c.Name, c.Handler)
+		}
+		h.Handler = handler
+	default:
+		return h, fmt.Errorf("bot %s: needs a command or a handler", c.Name)
+	}
+	return h, nil
+}
+
+// Runner feeds a node's live chat messages from other peers to hooks and
+// posts their replies. Our own messages, other bots' replies and backlog
+// syncs are never handed over, so a bot cannot answer itself, get into a
+// conversation with another bot or replay history.
+type Runner struct {
+	node  *node.Node
+	hooks []Hook
+	slots chan struct{}
+
+	cancel func()
+	ctx    context.Context
+	wg     sync.WaitGroup
+}
+
+func New(n *node.Node) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{node: n, slots: make(chan struct{}, maxRunning), ctx: ctx, cancel: cancel}
+}
+
+// Add registers h; it joins h's rooms so their traffic reaches us. Rooms
+// joined this way have no password.
+func (r *Runner) Add(h Hook) error {
+	if h.Handler == nil {
+		return errors.New("hook has no handler")
+	}
+	for _, name := range h.Rooms {
+		if !r.node.Rooms.Joined(name) {
+			if err := r.node.Join(name, ""); err != nil {
+				return err
+			}
+		}
+	}
+	r.hooks = append(r.hooks, h)
+	return nil
+}
+
+// Start dispatches messages until Stop. Hooks must be added first.
+func (r *Runner) Start() {
+	events, unsubscribe := r.node.Subscribe()
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer unsubscribe()
+		for {
+			select {
+			case ev := <-events:
+				if ev.Kind != node.Message || ev.Synced {
+					continue
+				}
+				env := ev.Message
+				if env.From == r.node.Rooms.PeerID || env.From == "system" || env.Bot {
+					continue
+				}
+				for i := range r.hooks {
+					if r.hooks[i].wants(env) {
+						r.dispatch(&r.hooks[i], env)
+					}
+				}
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop cancels running hooks and waits for them to return.
+func (r *Runner) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *Runner) dispatch(h *Hook, env protocol.Envelope) {
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		slog.Warn("Bot skipped message, too many hooks running", "bot", h.Name, "id", env.ID)
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() { <-r.slots }()
+
+		timeout := h.Timeout
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		ctx, cancel := context.WithTimeout(r.ctx, timeout)
+		defer cancel()
+		replies, err := h.Handler.Handle(ctx, env)
+		if err != nil {
+			slog.Warn("Bot failed", "bot", h.Name, "id", env.ID, "err", err)
+			return
+		}
+		for _, text := range replies {
+			if text == "" {
+				continue
+			}
+			if len(text) > MaxReply {
+				text = strings.ToValidUTF8(text[:MaxReply], "")
+			}
+			if _, err := r.node.SayAsBot(env.Room, text); err != nil {
+				slog.Warn("Bot could not reply", "bot", h.Name, "room", env.Room, "err", err)
+			}
+		}
+	}()
+}
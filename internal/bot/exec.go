@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"ephemeral/internal/protocol"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// maxOutput caps how much of a command's stdout and stderr is kept.
+const maxOutput = 64 << 10
+
+// Exec runs an executable for each message. The message is on stdin as
+// JSON and in EPHEMERAL_* variables; each non-empty line of stdout is
+// posted as a reply. The command runs without a shell, in Dir (the
+// temporary directory by default), with only PATH, the EPHEMERAL_*
+// variables and Env in its environment, and is killed at the deadline.
+type Exec struct {
+	Command []string
+	// Env lists extra KEY=VALUE pairs to pass through.
+	Env []string
+	Dir string
+}
+
+func (e *Exec) Handle(ctx context.Context, env protocol.Envelope) ([]string, error) {
+	input, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Dir = e.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = os.TempDir()
+	}
+	cmd.Env = append([]string{
+		"PATH=" + os.Getenv("PATH"),
+		"EPHEMERAL_ROOM=" + env.Room,
+		"EPHEMERAL_NICK=" + env.Nick,
+		"EPHEMERAL_FROM=" + env.From,
+		"EPHEMERAL_ID=" + env.ID,
+		"EPHEMERAL_TEXT=" + env.Payload,
+	}, e.Env...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Children that keep the pipes open do not hold us past the deadline.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", e.Command[0], ctx.Err())
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", e.Command[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", e.Command[0], err)
+	}
+	var replies []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			replies = append(replies, line)
+		}
+	}
+	return replies, nil
+}
+
+// limitedBuffer keeps the first maxOutput bytes written to it and
+// discards the rest without failing the writer.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
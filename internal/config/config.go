@@ -1,7 +1,16 @@
 package config
 
 import (
+	"ephemeral/internal/transport"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -9,8 +18,30 @@ import (
 type Config struct {
 	Nick       string         `yaml:"nick"`
 	Port       int            `yaml:"port"`
+	// Listen and Interfaces narrow the addresses we bind to and the
+	// interfaces discovery runs on; empty means all of them.
+	Listen     []string       `yaml:"listen"`
+	Interfaces []string       `yaml:"interfaces"`
+	// Codec is the wire codec offered to peers we dial: "json" (default,
+	// readable) or "binary" (compact, falls back to JSON).
+	Codec      string         `yaml:"codec"`
+	// Compress deflates payloads over 1 KiB for peers that accept it.
+	Compress   bool           `yaml:"compress"`
 	Discovery  DiscoveryConfig `yaml:"discovery"`
+	Overlay    OverlayConfig  `yaml:"overlay"`
+	// Peers are host:port addresses dialled directly and kept connected,
+	// for networks where discovery is blocked.
+	Peers      []string       `yaml:"peers"`
+	Limits     LimitsConfig   `yaml:"limits"`
+	// Downloads is where accepted files are saved unless /accept names a
+	// directory; empty means the current directory.
+	Downloads  string         `yaml:"downloads"`
+	// Control is the path of a Unix socket serving the local JSON-lines
+	// control API to scripts; empty disables it.
+	Control    string         `yaml:"control"`
 	Rooms      []RoomConfig   `yaml:"rooms"`
+	// Bots are hooks run for incoming chat messages.
+	Bots       []BotConfig    `yaml:"bots"`
 	Security   SecurityConfig `yaml:"security"`
 	Logging    LoggingConfig  `yaml:"logging"`
 }
@@ -20,44 +51,217 @@ type DiscoveryConfig struct {
 	UDPFallback bool `yaml:"udp_fallback"`
 }
 
+// OverlayConfig selects between the full mesh and the gossip overlay.
+// Mode is "mesh", "gossip" or "auto" (mesh until MeshThreshold peers).
+type OverlayConfig struct {
+	Mode          string `yaml:"mode"`
+	ActiveSize    int    `yaml:"active_size"`
+	MeshThreshold int    `yaml:"mesh_threshold"`
+}
+
+// LimitsConfig bounds the connections the transport accepts and makes;
+// zero means unlimited.
+type LimitsConfig struct {
+	MaxInbound       int           `yaml:"max_inbound"`
+	MaxOutbound      int           `yaml:"max_outbound"`
+	MaxPerIP         int           `yaml:"max_per_ip"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+}
+
+// BotConfig describes one bot: either an executable (Command, with Env
+// and Dir) or a Go handler registered under Handler. It sees messages from
+// other peers in Rooms (all joined rooms if empty) that match the Match
+// regular expression, and is stopped after Timeout.
+type BotConfig struct {
+	Name    string        `yaml:"name"`
+	Rooms   []string      `yaml:"rooms"`
+	Match   string        `yaml:"match"`
+	Command []string      `yaml:"command"`
+	Handler string        `yaml:"handler"`
+	Env     []string      `yaml:"env"`
+	Dir     string        `yaml:"dir"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RoomConfig is a room joined at startup. Encrypted rooms need the
+// Password their members share.
 type RoomConfig struct {
 	Name      string `yaml:"name"`
 	Encrypted bool   `yaml:"encrypted"`
+	Password  string `yaml:"password"`
 }
 
+// SecurityConfig exists for settings that would weaken the in-memory-only
+// model; Validate rejects any of them being turned on.
 type SecurityConfig struct {
 	PersistKeys     bool `yaml:"persist_keys"`
 	KeyRotationDays int  `yaml:"key_rotation_days"`
 }
 
+// LoggingConfig sets the least severe level logged (debug, info, warn,
+// error or off). With EphemeralLogs, logs only go to the terminal and are
+// never written to disk.
 type LoggingConfig struct {
 	Level         string `yaml:"level"`
 	EphemeralLogs bool   `yaml:"ephemeral_logs"`
 }
 
+// EnvPrefix starts every environment variable that overrides a setting.
+const EnvPrefix = "EPHEMERAL_"
+
+// Load reads the YAML file at path over the defaults.
 func Load(path string) (*Config, error) {
+	cfg := Default()
+	if err := cfg.ReadFile(path); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ReadFile overlays the settings in the YAML file at path; settings the
+// file leaves out keep their current values. Unknown keys are an error so
+// typos do not go unnoticed.
+func (c *Config) ReadFile(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
-	var cfg Config
 	decoder := yaml.NewDecoder(f)
-	if err := decoder.Decode(&cfg); err != nil {
-		return nil, err
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// DefaultPath is where the config file is looked for when none is given:
+// ephemeral/config.yaml under $XDG_CONFIG_HOME (~/.config by default). It
+// is empty if no such directory can be determined.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
 	}
-	return &cfg, nil
+	return filepath.Join(dir, "ephemeral", "config.yaml")
+}
+
+// ApplyEnv overrides settings from environment variables named after
+// their YAML keys, e.g. EPHEMERAL_NICK, EPHEMERAL_DISCOVERY_MDNS or
+// EPHEMERAL_LIMITS_MAX_INBOUND. Lists are comma-separated. Rooms and bots
+// can only be set in the file.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("yaml")
+		if tag == "" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("can only be set in the config file")
+	}
+	return nil
+}
+
+// Validate reports settings that cannot be honoured.
+func (c *Config) Validate() error {
+	for _, r := range c.Rooms {
+		switch {
+		case r.Name == "":
+			return errors.New("rooms: a room has no name")
+		case r.Name == "global" && r.Encrypted:
+			return errors.New("rooms: global is shared by everyone and cannot be encrypted")
+		case r.Encrypted && r.Password == "":
+			return fmt.Errorf("rooms: %s is encrypted but has no password", r.Name)
+		case !r.Encrypted && r.Password != "":
+			return fmt.Errorf("rooms: %s has a password but is not encrypted", r.Name)
+		}
+	}
+	if c.Security.PersistKeys {
+		return errors.New("security: persist_keys is not supported, keys only ever live in memory")
+	}
+	if c.Security.KeyRotationDays != 0 {
+		return errors.New("security: key_rotation_days is not supported, room keys come from the password, so change it to rotate")
+	}
+	return nil
 }
 
 func Default() *Config {
 	return &Config{
 		Nick: "guest",
 		Port: 9999,
+		Codec: "json",
+		Compress: true,
 		Discovery: DiscoveryConfig{
 			MDNS:        true,
 			UDPFallback: true,
 		},
+		Overlay: OverlayConfig{
+			Mode:          "auto",
+			ActiveSize:    6,
+			MeshThreshold: 32,
+		},
+		Limits: LimitsConfig{
+			MaxInbound:       transport.DefaultMaxInbound,
+			MaxOutbound:      transport.DefaultMaxOutbound,
+			MaxPerIP:         transport.DefaultMaxPerIP,
+			HandshakeTimeout: transport.DefaultHandshakeTimeout,
+		},
 		Rooms: []RoomConfig{
 			{Name: "global", Encrypted: false},
 		},
@@ -0,0 +1,351 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxLine bounds one request line.
+const maxLine = 1 << 20
+
+// writeTimeout is how long a client may leave a line unread before its
+// session is dropped.
+const writeTimeout = 5 * time.Second
+
+// Request is one line a client sends. ID is echoed in the response so
+// clients can match them up; Room, Password, Text, Bot and Rooms are the
+// method's parameters.
+//
+// Methods: rooms, join (Room, Password), leave (Room), send (Room, Text, Bot),
+// history (Room), peers, subscribe (Rooms, optional) and unsubscribe.
+type Request struct {
+	ID       json.RawMessage `json:"id,omitempty"`
+	Method   string          `json:"method"`
+	Room     string          `json:"room,omitempty"`
+	Password string          `json:"password,omitempty"`
+	Text     string          `json:"text,omitempty"`
+	Bot      bool            `json:"bot,omitempty"`
+	Rooms    []string        `json:"rooms,omitempty"`
+}
+
+type Response struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result any             `json:"result,omitempty"`
+}
+
+// Event is pushed to subscribed clients between responses.
+type Event struct {
+	// Event is "message", "peer_up", "peer_down" or "dropped", which
+	// reports that Count events were lost while the client fell behind.
+	Event   string   `json:"event"`
+	Message *Message `json:"message,omitempty"`
+	Peer    *Peer    `json:"peer,omitempty"`
+	Count   int      `json:"count,omitempty"`
+}
+
+type Message struct {
+	ID    string `json:"id"`
+	Room  string `json:"room"`
+	From  string `json:"from"`
+	Nick  string `json:"nick"`
+	Text  string `json:"text"`
+	TS    int64  `json:"ts"`
+	Clock uint64 `json:"clock,omitempty"`
+	// Self marks messages this node sent, so bots can skip their own.
+	Self bool `json:"self,omitempty"`
+	// Bot marks a bot's reply; bots should not answer those either.
+	Bot bool `json:"bot,omitempty"`
+}
+
+type Peer struct {
+	ID    string   `json:"id"`
+	Nick  string   `json:"nick"`
+	Addr  string   `json:"addr,omitempty"`
+	RTTMs float64  `json:"rtt_ms,omitempty"`
+	Rooms []string `json:"rooms,omitempty"`
+	// Left is set on peer_down when the peer announced its departure.
+	Left bool `json:"left,omitempty"`
+}
+
+type Room struct {
+	Name      string `json:"name"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// Server exposes a running node to local scripts as JSON lines: one
+// Request per line in, one Response per request and any subscribed Events
+// out.
+type Server struct {
+	node *node.Node
+
+	mu       sync.Mutex
+	ln       net.Listener
+	path     string
+	sessions map[io.Closer]struct{}
+	wg       sync.WaitGroup
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func New(n *node.Node) *Server {
+	return &Server{node: n, sessions: make(map[io.Closer]struct{}), closed: make(chan struct{})}
+}
+
+// Listen serves the API on a Unix socket at path that only the current
+// user can connect to. A stale socket left by a crashed instance is
+// replaced; one that still answers is not.
+func (s *Server) Listen(path string) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return fmt.Errorf("%s is in use by another instance", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.ln, s.path = ln, path
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.Serve(conn, conn, false)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Close stops listening, ends every session and removes the socket.
+func (s *Server) Close() {
+	s.once.Do(func() { close(s.closed) })
+	s.mu.Lock()
+	if s.ln != nil {
+		s.ln.Close()
+		os.Remove(s.path)
+	}
+	for c := range s.sessions {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Serve runs one session, reading requests from r until it ends. With
+// subscribed set the session receives every event from the start, as if
+// it had sent subscribe, and keeps receiving them after r ends until the
+// server is closed.
+func (s *Server) Serve(r io.Reader, w io.Writer, subscribed bool) {
+	ss := &session{s: s, w: w, enc: json.NewEncoder(w)}
+	if c, ok := r.(io.Closer); ok {
+		s.mu.Lock()
+		s.sessions[c] = struct{}{}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.sessions, c)
+			s.mu.Unlock()
+		}()
+	}
+	defer ss.unsubscribe()
+	if subscribed {
+		ss.subscribe(nil)
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxLine)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var req Request
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			ss.write(Response{Error: fmt.Sprintf("invalid request: %v", err)})
+			continue
+		}
+		result, err := ss.call(req)
+		resp := Response{ID: req.ID, OK: err == nil, Result: result}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		ss.write(resp)
+	}
+	if subscribed {
+		<-s.closed
+	}
+}
+
+type session struct {
+	s   *Server
+	wmu sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+
+	smu    sync.Mutex
+	cancel func()
+	done   chan struct{}
+}
+
+func (ss *session) call(req Request) (any, error) {
+	n := ss.s.node
+	switch req.Method {
+	case "rooms":
+		rooms := []Room{}
+		for _, name := range n.Rooms.Names() {
+			rooms = append(rooms, Room{Name: name, Encrypted: n.Rooms.Encrypted(name)})
+		}
+		return rooms, nil
+	case "join":
+		return nil, n.Join(req.Room, req.Password)
+	case "leave":
+		if !n.Leave(req.Room) {
+			return nil, fmt.Errorf("cannot leave %s", req.Room)
+		}
+		return nil, nil
+	case "send":
+		if req.Text == "" {
+			return nil, errors.New("text is empty")
+		}
+		say := n.Say
+		if req.Bot {
+			say = n.SayAsBot
+		}
+		env, err := say(req.Room, req.Text)
+		if err != nil {
+			return nil, err
+		}
+		return ss.message(env), nil
+	case "history":
+		if !n.Rooms.Joined(req.Room) {
+			return nil, fmt.Errorf("not in room %s", req.Room)
+		}
+		msgs := []Message{}
+		for _, env := range n.Rooms.GetMessages(req.Room) {
+			msgs = append(msgs, ss.message(env))
+		}
+		return msgs, nil
+	case "peers":
+		peers := []Peer{}
+		for _, p := range n.Transport.Peers() {
+			peers = append(peers, Peer{
+				ID:    p.ID,
+				Nick:  p.Nick,
+				Addr:  p.Addr,
+				RTTMs: float64(p.RTT.Microseconds()) / 1000,
+				Rooms: p.Rooms,
+			})
+		}
+		return peers, nil
+	case "subscribe":
+		ss.subscribe(req.Rooms)
+		return nil, nil
+	case "unsubscribe":
+		ss.unsubscribe()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+// subscribe streams node events to the client, only messages for rooms
+// if it is not empty. Subscribing again replaces the filter.
+func (ss *session) subscribe(rooms []string) {
+	ss.unsubscribe()
+	events, cancel := ss.s.node.Subscribe()
+	done := make(chan struct{})
+	ss.smu.Lock()
+	ss.cancel, ss.done = cancel, done
+	ss.smu.Unlock()
+	go func() {
+		defer close(done)
+		for ev := range events {
+			switch ev.Kind {
+			case node.Message:
+				if len(rooms) > 0 && !slices.Contains(rooms, ev.Message.Room) {
+					continue
+				}
+				m := ss.message(ev.Message)
+				ss.write(Event{Event: "message", Message: &m})
+			case node.PeerUp:
+				ss.write(Event{Event: "peer_up", Peer: &Peer{ID: ev.Peer.ID, Nick: ev.Peer.Nick, Addr: ev.Peer.Addr}})
+			case node.PeerDown:
+				ss.write(Event{Event: "peer_down", Peer: &Peer{ID: ev.Peer.ID, Nick: ev.Peer.Nick, Addr: ev.Peer.Addr, Left: ev.Peer.Left, Rooms: ev.Peer.Rooms}})
+			case node.Dropped:
+				ss.write(Event{Event: "dropped", Count: ev.Count})
+			}
+		}
+	}()
+}
+
+func (ss *session) unsubscribe() {
+	ss.smu.Lock()
+	cancel, done := ss.cancel, ss.done
+	ss.cancel, ss.done = nil, nil
+	ss.smu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (ss *session) message(env protocol.Envelope) Message {
+	return NewMessage(env, ss.s.node.Rooms.PeerID)
+}
+
+// NewMessage describes an opened chat envelope; self is our peer ID.
+func NewMessage(env protocol.Envelope, self string) Message {
+	return Message{
+		ID:    env.ID,
+		Room:  env.Room,
+		From:  env.From,
+		Nick:  env.Nick,
+		Text:  env.Payload,
+		TS:    env.TS,
+		Clock: env.Clock,
+		Self:  env.From == self,
+		Bot:   env.Bot,
+	}
+}
+
+func (ss *session) write(v any) {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	if c, ok := ss.w.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if err := ss.enc.Encode(v); err != nil {
+		if c, ok := ss.w.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
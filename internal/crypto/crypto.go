@@ -10,20 +10,26 @@ import (
 	"errors"
 	"io"
 
-	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/argon2"
 )
 
+// Argon2id parameters for DeriveKey, the second recommended option of
+// RFC 9106: three passes over 64 MiB. Passphrases are chosen by people, so
+// each guess at one must cost as much as a join can afford.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+// DeriveKey stretches a passphrase into a 256-bit key with Argon2id.
 func DeriveKey(passphrase, salt string) ([]byte, error) {
-	hash := sha256.New
-	kdf := hkdf.New(hash, []byte(passphrase), []byte(salt), nil)
-	key := make([]byte, 32)
-	if _, err := io.ReadFull(kdf, key); err != nil {
-		return nil, err
-	}
-	return key, nil
+	return argon2.IDKey([]byte(passphrase), []byte(salt), argonTime, argonMemory, argonThreads, 32), nil
 }
 
-func Encrypt(key []byte, plaintext string) (string, error) {
+// Encrypt seals plaintext with AES-256-GCM. additionalData is authenticated
+// but not encrypted; Decrypt fails unless it is given the same bytes.
+func Encrypt(key []byte, plaintext string, additionalData []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -39,11 +45,11 @@ func Encrypt(key []byte, plaintext string) (string, error) {
 		return "", err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), additionalData)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-func Decrypt(key []byte, cryptoText string) (string, error) {
+func Decrypt(key []byte, cryptoText string, additionalData []byte) (string, error) {
 	ciphertext, err := base64.StdEncoding.DecodeString(cryptoText)
 	if err != nil {
 		return "", err
@@ -65,7 +71,7 @@ func Decrypt(key []byte, cryptoText string) (string, error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return "", err
 	}
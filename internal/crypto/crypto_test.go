@@ -21,12 +21,12 @@ func TestEncryptDecrypt(t *testing.T) {
 	key, _ := DeriveKey("pass", "salt")
 	plaintext := "Hello World"
 	
-	encrypted, err := Encrypt(key, plaintext)
+	encrypted, err := Encrypt(key, plaintext, nil)
 	if err != nil {
 		t.Fatalf("Encrypt failed: %v", err)
 	}
 	
-	decrypted, err := Decrypt(key, encrypted)
+	decrypted, err := Decrypt(key, encrypted, nil)
 	if err != nil {
 		t.Fatalf("Decrypt failed: %v", err)
 	}
@@ -40,14 +40,26 @@ func TestDecryptTampered(t *testing.T) {
 	key, _ := DeriveKey("pass", "salt")
 	plaintext := "Hello World"
 	
-	encrypted, _ := Encrypt(key, plaintext)
+	encrypted, _ := Encrypt(key, plaintext, nil)
 	
 	bytes, _ := base64.StdEncoding.DecodeString(encrypted)
 	bytes[len(bytes)-1] ^= 0x01
 	tampered := base64.StdEncoding.EncodeToString(bytes)
 	
-	_, err := Decrypt(key, tampered)
+	_, err := Decrypt(key, tampered, nil)
 	if err == nil {
 		t.Error("Expected error for tampered ciphertext, got nil")
 	}
 }
+
+func TestDecryptWrongAdditionalData(t *testing.T) {
+	key, _ := DeriveKey("pass", "salt")
+	encrypted, _ := Encrypt(key, "Hello World", []byte("room|alice|m1"))
+
+	if _, err := Decrypt(key, encrypted, []byte("room|alice|m1")); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if _, err := Decrypt(key, encrypted, []byte("room|mallory|m1")); err == nil {
+		t.Error("Expected error for changed additional data, got nil")
+	}
+}
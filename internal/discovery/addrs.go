@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+)
+
+// UDPMulticastGroupV6 is the link-local group the IPv6 fallback announces
+// on, since IPv6 has no broadcast address.
+const UDPMulticastGroupV6 = "ff02::ef:1"
+
+// DialAddrs lists every host:port the peer advertised, ready for
+// transport.Dial to race.
+func (p Peer) DialAddrs() []string {
+	port := strconv.Itoa(p.Port)
+	out := make([]string, 0, len(p.Addrs)+1)
+	for _, a := range p.Addrs {
+		out = append(out, net.JoinHostPort(a.String(), port))
+	}
+	if len(out) == 0 && p.IP != nil {
+		out = append(out, net.JoinHostPort(p.IP.String(), port))
+	}
+	return out
+}
+
+// scoped attaches a zone to a link-local IPv6 address. An address learned
+// without one (mDNS answers and discovery packets do not carry it) could be
+// on any link, so it is expanded to one candidate per IPv6 interface in
+// ifaces and the transport races them.
+func scoped(ip net.IP, zone string, ifaces []net.Interface) []net.IPAddr {
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return []net.IPAddr{{IP: ip}}
+	}
+	if zone != "" {
+		return []net.IPAddr{{IP: ip, Zone: zone}}
+	}
+	var out []net.IPAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			out = append(out, net.IPAddr{IP: ip, Zone: iface.Name})
+		}
+	}
+	return out
+}
+
+// mergeAddrs appends the addresses of add not already in addrs.
+func mergeAddrs(addrs, add []net.IPAddr) []net.IPAddr {
+	for _, a := range add {
+		dup := false
+		for _, b := range addrs {
+			if a.IP.Equal(b.IP) && a.Zone == b.Zone {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
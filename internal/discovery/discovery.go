@@ -3,8 +3,11 @@ package discovery
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"ephemeral/internal/netutil"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
@@ -21,6 +24,9 @@ type Peer struct {
 	Nick string
 	IP   net.IP
 	Port int
+	// Addrs is every address the peer is known by, including IP and
+	// zone-scoped link-local IPv6 ones.
+	Addrs []net.IPAddr
 }
 
 type Service struct {
@@ -29,8 +35,12 @@ type Service struct {
 	PeerID    string
 	MDNSEnabled bool
 	UDPEnabled  bool
+	// Scope limits the interfaces discovery runs on and the addresses it
+	// advertises; the zero Scope uses them all.
+	Scope netutil.Scope
 	
 	peers     map[string]Peer
+	peersMu   sync.Mutex
 	newPeerCh chan Peer
 	
 	mdnsServer *zeroconf.Server
@@ -66,11 +76,13 @@ func (s *Service) Start() error {
 	return nil
 }
 
+// Stop withdraws our mDNS record, which multicasts a goodbye (TTL 0) so
+// resolvers forget us at once, and stops discovery.
 func (s *Service) Stop() {
-	s.cancel()
 	if s.mdnsServer != nil {
 		s.mdnsServer.Shutdown()
 	}
+	s.cancel()
 }
 
 func (s *Service) Peers() <-chan Peer {
@@ -82,20 +94,37 @@ func (s *Service) startMDNS() error {
 		"nick=" + s.Nick,
 		"id=" + s.PeerID,
 	}
-	server, err := zeroconf.Register(
-		s.Nick,
-		MDNSServiceType,
-		MDNSDomain,
-		s.Port,
-		meta,
-		nil,
-	)
+	var server *zeroconf.Server
+	var err error
+	if len(s.Scope.IPs) > 0 {
+		// Explicit listen addresses are advertised instead of everything
+		// the interfaces carry.
+		host, _ := os.Hostname()
+		var ips []string
+		for _, a := range s.Scope.IPs {
+			ips = append(ips, a.IP.String())
+		}
+		server, err = zeroconf.RegisterProxy(s.Nick, MDNSServiceType, MDNSDomain, s.Port, host, ips, meta, s.Scope.Interfaces)
+	} else {
+		server, err = zeroconf.Register(
+			s.Nick,
+			MDNSServiceType,
+			MDNSDomain,
+			s.Port,
+			meta,
+			s.Scope.Interfaces,
+		)
+	}
 	if err != nil {
 		return err
 	}
 	s.mdnsServer = server
 
-	resolver, err := zeroconf.NewResolver(nil)
+	var opts []zeroconf.ClientOption
+	if len(s.Scope.Interfaces) > 0 {
+		opts = append(opts, zeroconf.SelectIfaces(s.Scope.Interfaces))
+	}
+	resolver, err := zeroconf.NewResolver(opts...)
 	if err != nil {
 		return err
 	}
@@ -125,12 +154,22 @@ func (s *Service) startMDNS() error {
 				}
 			}
 
-			if id != "" && len(entry.AddrIPv4) > 0 {
+			ifaces := s.Scope.MulticastInterfaces()
+			var addrs []net.IPAddr
+			for _, ip := range entry.AddrIPv6 {
+				addrs = mergeAddrs(addrs, scoped(ip, "", ifaces))
+			}
+			for _, ip := range entry.AddrIPv4 {
+				addrs = mergeAddrs(addrs, scoped(ip, "", ifaces))
+			}
+
+			if id != "" && len(addrs) > 0 {
 				peer := Peer{
-					ID:   id,
-					Nick: nick,
-					IP:   entry.AddrIPv4[0],
-					Port: entry.Port,
+					ID:    id,
+					Nick:  nick,
+					IP:    addrs[0].IP,
+					Port:  entry.Port,
+					Addrs: addrs,
 				}
 				s.handleFoundPeer(peer)
 			}
@@ -149,18 +188,37 @@ type UDPDiscoveryPacket struct {
 	Nick string `json:"nick"`
 	ID   string `json:"id"`
 	Port int    `json:"port"`
+	// Addrs lists the sender's own addresses, without zones, so a peer
+	// heard over one family can still be dialled over the other.
+	Addrs []string `json:"addrs,omitempty"`
 }
 
+// startUDPListener listens for IPv4 broadcasts and, on every IPv6-capable
+// interface in scope, for announcements to UDPMulticastGroupV6.
 func (s *Service) startUDPListener() {
+	group := &net.UDPAddr{IP: net.ParseIP(UDPMulticastGroupV6), Port: UDPBroadcastPort}
+	for _, iface := range s.Scope.MulticastInterfaces() {
+		iface := iface
+		conn, err := net.ListenMulticastUDP("udp6", &iface, group)
+		if err != nil {
+			continue
+		}
+		go s.serveUDP(conn)
+	}
+
 	addr := &net.UDPAddr{
 		Port: UDPBroadcastPort,
 		IP:   net.ParseIP("0.0.0.0"),
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
-		log.Printf("UDP listen error: %v", err)
+		slog.Warn("UDP discovery cannot listen", "err", err)
 		return
 	}
+	s.serveUDP(conn)
+}
+
+func (s *Service) serveUDP(conn *net.UDPConn) {
 	defer conn.Close()
 
 	buf := make([]byte, 1024)
@@ -183,13 +241,29 @@ func (s *Service) startUDPListener() {
 			if pkt.ID == s.PeerID {
 				continue
 			}
+			// The IPv4 socket hears broadcasts from every interface.
+			if remoteAddr.Zone == "" && !s.Scope.Contains(remoteAddr.IP) {
+				continue
+			}
 
 			if pkt.Cmd == "DISCOVER" {
+				ifaces := s.Scope.MulticastInterfaces()
+				addrs := scoped(remoteAddr.IP, remoteAddr.Zone, ifaces)
+				for _, a := range pkt.Addrs {
+					ip := net.ParseIP(a)
+					if ip == nil {
+						continue
+					}
+					// A link-local address of the sender is on the link the
+					// packet arrived on, if it came in over IPv6.
+					addrs = mergeAddrs(addrs, scoped(ip, remoteAddr.Zone, ifaces))
+				}
 				peer := Peer{
-					ID:   pkt.ID,
-					Nick: pkt.Nick,
-					IP:   remoteAddr.IP,
-					Port: pkt.Port,
+					ID:    pkt.ID,
+					Nick:  pkt.Nick,
+					IP:    remoteAddr.IP,
+					Port:  pkt.Port,
+					Addrs: addrs,
 				}
 				s.handleFoundPeer(peer)
 			}
@@ -203,44 +277,106 @@ func (s *Service) startUDPBroadcaster() {
 		IP:   net.ParseIP("255.255.255.255"),
 	}
 	
-	conn, err := net.DialUDP("udp", nil, addr)
+	conn, err := net.DialUDP("udp4", nil, addr)
 	if err != nil {
-		log.Printf("UDP dial error: %v", err)
+		slog.Warn("UDP discovery cannot broadcast", "err", err)
 		return
 	}
 	defer conn.Close()
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	// When interfaces are selected, broadcast only on their subnets
+	// rather than to 255.255.255.255, which goes out the default route.
+	var bcast []*net.UDPAddr
+	for _, n := range s.Scope.Nets() {
+		if ip := netutil.Broadcast(n); ip != nil {
+			bcast = append(bcast, &net.UDPAddr{IP: ip, Port: UDPBroadcastPort})
+		}
+	}
+	conn4, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err == nil {
+		defer conn4.Close()
+	}
 
-	pkt := UDPDiscoveryPacket{
-		Cmd:  "DISCOVER",
-		Nick: s.Nick,
-		ID:   s.PeerID,
-		Port: s.Port,
+	// IPv6 has no broadcast, so the same packet goes to a link-local
+	// multicast group on each interface. Failure here is not fatal: the
+	// host may simply have no IPv6.
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{})
+	if err == nil {
+		defer conn6.Close()
 	}
-	data, _ := json.Marshal(pkt)
+	group := net.ParseIP(UDPMulticastGroupV6)
 
+	// The first announcement goes out at once, so short-lived instances
+	// such as `ephemeral send` are found before they give up.
+	announce := func() {
+		pkt := UDPDiscoveryPacket{
+			Cmd:  "DISCOVER",
+			Nick: s.Nick,
+			ID:   s.PeerID,
+			Port: s.Port,
+		}
+		for _, a := range s.Scope.Addrs() {
+			pkt.Addrs = append(pkt.Addrs, a.IP.String())
+		}
+		data, _ := json.Marshal(pkt)
+
+		if len(s.Scope.Interfaces) == 0 {
+			conn.Write(data)
+		} else if conn4 != nil {
+			for _, addr := range bcast {
+				conn4.WriteToUDP(data, addr)
+			}
+		}
+		if conn6 != nil {
+			for _, iface := range s.Scope.MulticastInterfaces() {
+				conn6.WriteToUDP(data, &net.UDPAddr{IP: group, Port: UDPBroadcastPort, Zone: iface.Name})
+			}
+		}
+	}
+	announce()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			conn.Write(data)
+			announce()
 		}
 	}
 }
 
 func (s *Service) OnlineCount() int {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
 	return len(s.peers) + 1
 }
 
+// Known lists every peer discovered so far.
+func (s *Service) Known() []Peer {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// handleFoundPeer announces a peer the first time it is seen; later
+// sightings over other families or interfaces only add to its addresses.
 func (s *Service) handleFoundPeer(p Peer) {
-	if _, exists := s.peers[p.ID]; !exists {
-		s.peers[p.ID] = p
-		select {
-		case s.newPeerCh <- p:
-		default:
-		}
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	if known, exists := s.peers[p.ID]; exists {
+		known.Addrs = mergeAddrs(known.Addrs, p.Addrs)
+		s.peers[p.ID] = known
+		return
+	}
+	s.peers[p.ID] = p
+	select {
+	case s.newPeerCh <- p:
+	default:
 	}
 }
@@ -0,0 +1,302 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"ephemeral/internal/discovery"
+	"ephemeral/internal/netutil"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+)
+
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Warn:
+		return "warn"
+	}
+	return "fail"
+}
+
+// Finding is the outcome of one check, with what to do about it unless
+// the check passed.
+type Finding struct {
+	Check  string
+	Status Status
+	Detail string
+	Fix    string
+}
+
+type Options struct {
+	Scope   netutil.Scope
+	Port    int
+	UDPPort int
+	// Timeout bounds each check that waits for its own traffic.
+	Timeout time.Duration
+}
+
+// probeService is registered for the mDNS check instead of the chat
+// service, so running instances do not mistake the probe for a peer.
+const probeService = "_ephemeral-doctor._tcp"
+
+// Run performs every check in turn.
+func Run(opts Options) []Finding {
+	findings := []Finding{Interfaces(opts.Scope), TCPPort(opts.Port)}
+	findings = append(findings, UDP(opts.Scope, opts.UDPPort, opts.Timeout)...)
+	return append(findings, MDNS(opts.Scope, opts.Timeout), Handshake(opts.Timeout))
+}
+
+// virtualPrefixes name interfaces that are usually VPNs, containers or
+// bridges, where announcing ourselves rarely helps.
+var virtualPrefixes = []string{"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "tun", "tap", "wg", "utun", "tailscale", "zt"}
+
+// Interfaces reports the interfaces discovery will use.
+func Interfaces(scope netutil.Scope) Finding {
+	f := Finding{Check: "Network interfaces"}
+	ifaces := scope.Interfaces
+	if len(ifaces) == 0 {
+		ifaces, _ = net.Interfaces()
+	}
+	var usable, virtual []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		var ips []string
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		desc := fmt.Sprintf("%s (%s)", iface.Name, strings.Join(ips, ", "))
+		if iface.Flags&net.FlagMulticast == 0 {
+			desc += " no multicast"
+		}
+		usable = append(usable, desc)
+		for _, p := range virtualPrefixes {
+			if strings.HasPrefix(iface.Name, p) {
+				virtual = append(virtual, iface.Name)
+				break
+			}
+		}
+	}
+	switch {
+	case len(usable) == 0:
+		f.Status = Fail
+		f.Detail = "no interface is up with an address"
+		f.Fix = "connect to the network your teammates are on"
+	case len(virtual) > 0 && len(scope.Interfaces) == 0:
+		f.Status = Warn
+		f.Detail = strings.Join(usable, "; ")
+		f.Fix = fmt.Sprintf("%s look virtual (VPN, containers); pick the LAN one with --interface", strings.Join(virtual, ", "))
+	default:
+		f.Detail = strings.Join(usable, "; ")
+	}
+	return f
+}
+
+// TCPPort checks that the chat port can be bound.
+func TCPPort(port int) Finding {
+	f := Finding{Check: fmt.Sprintf("TCP port %d", port)}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		f.Status = Fail
+		f.Detail = err.Error()
+		if errors.Is(err, syscall.EADDRINUSE) {
+			f.Detail = "already in use"
+			f.Fix = "another program (or Ephemeral instance) holds it; quit it or start with --port 0"
+		} else {
+			f.Fix = "start with --port 0 to take any free port"
+		}
+		return f
+	}
+	ln.Close()
+	f.Detail = "free"
+	return f
+}
+
+// UDP checks that the discovery port can be bound and that a broadcast
+// sent to it comes back.
+func UDP(scope netutil.Scope, port int, timeout time.Duration) []Finding {
+	bind := Finding{Check: fmt.Sprintf("UDP port %d", port)}
+	bcast := Finding{Check: "UDP broadcast"}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			bind.Status = Warn
+			bind.Detail = "already in use, probably by a running Ephemeral"
+			bind.Fix = "only one instance per machine hears UDP discovery; others rely on mDNS"
+		} else {
+			bind.Status = Fail
+			bind.Detail = err.Error()
+			bind.Fix = "UDP discovery cannot run; rely on mDNS or --peer"
+		}
+		bcast.Status = Warn
+		bcast.Detail = "not tested, the port could not be bound"
+		return []Finding{bind, bcast}
+	}
+	defer conn.Close()
+	bind.Detail = "free"
+
+	targets := []*net.UDPAddr{{IP: net.IPv4bcast, Port: port}}
+	for _, n := range scope.Nets() {
+		if ip := netutil.Broadcast(n); ip != nil {
+			targets = append(targets, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	probe := []byte("ephemeral-doctor " + uuid.New().String())
+	out, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		bcast.Status = Fail
+		bcast.Detail = err.Error()
+		return []Finding{bind, bcast}
+	}
+	defer out.Close()
+	var sendErrs []string
+	for _, t := range targets {
+		if _, err := out.WriteToUDP(probe, t); err != nil {
+			sendErrs = append(sendErrs, fmt.Sprintf("%s: %v", t.IP, err))
+		}
+	}
+	if len(sendErrs) == len(targets) {
+		bcast.Status = Fail
+		bcast.Detail = strings.Join(sendErrs, "; ")
+		bcast.Fix = "the host has no route for broadcasts; choose the LAN with --interface"
+		return []Finding{bind, bcast}
+	}
+
+	buf := make([]byte, 512)
+	deadline := time.Now().Add(timeout)
+	conn.SetReadDeadline(deadline)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			bcast.Status = Warn
+			bcast.Detail = "sent, but our own broadcast never arrived"
+			bcast.Fix = fmt.Sprintf("a firewall may drop UDP %d; allow it, or rely on mDNS or --peer", port)
+			return []Finding{bind, bcast}
+		}
+		if bytes.Equal(buf[:n], probe) {
+			bcast.Detail = "sent and received"
+			return []Finding{bind, bcast}
+		}
+	}
+}
+
+// MDNS registers a probe service and browses for it, which only succeeds
+// if multicast DNS leaves and re-enters this host.
+func MDNS(scope netutil.Scope, timeout time.Duration) Finding {
+	f := Finding{Check: "mDNS multicast"}
+	instance := "probe-" + uuid.New().String()[:8]
+	server, err := zeroconf.Register(instance, probeService, discovery.MDNSDomain, 9, []string{"probe"}, scope.Interfaces)
+	if err != nil {
+		f.Status = Fail
+		f.Detail = err.Error()
+		f.Fix = "no interface accepts multicast; use --peer host:port to connect directly"
+		return f
+	}
+	defer server.Shutdown()
+
+	var opts []zeroconf.ClientOption
+	if len(scope.Interfaces) > 0 {
+		opts = append(opts, zeroconf.SelectIfaces(scope.Interfaces))
+	}
+	resolver, err := zeroconf.NewResolver(opts...)
+	if err != nil {
+		f.Status = Fail
+		f.Detail = err.Error()
+		f.Fix = "use --peer host:port to connect directly"
+		return f
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, probeService, discovery.MDNSDomain, entries); err != nil {
+		f.Status = Fail
+		f.Detail = err.Error()
+		f.Fix = "use --peer host:port to connect directly"
+		return f
+	}
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				// The resolver gave up early; wait out the timeout
+				// without spinning on the closed channel.
+				entries = nil
+				continue
+			}
+			if e.Instance == instance {
+				f.Detail = "our own announcement was seen"
+				return f
+			}
+		case <-ctx.Done():
+			f.Status = Warn
+			f.Detail = "our own announcement was not seen"
+			f.Fix = "multicast looks blocked (Wi-Fi client isolation or a firewall on UDP 5353); UDP discovery or --peer still work"
+			return f
+		}
+	}
+}
+
+// Handshake links two transports over loopback and passes a message,
+// which exercises the handshake and codecs without the network.
+func Handshake(timeout time.Duration) Finding {
+	f := Finding{Check: "Loopback handshake"}
+	a := transport.NewTCPOn([]string{"127.0.0.1:0"}, "doctor-a", "doctor")
+	b := transport.NewTCPOn([]string{"127.0.0.1:0"}, "doctor-b", "doctor")
+	b.Codecs = []string{protocol.CodecBinary, protocol.CodecJSON}
+	for _, tr := range []*transport.Mesh{a, b} {
+		if err := tr.Start(); err != nil {
+			f.Status = Fail
+			f.Detail = err.Error()
+			f.Fix = "local TCP listeners are refused; check security software"
+			return f
+		}
+		defer tr.Stop()
+	}
+	start := time.Now()
+	if err := b.Dial("doctor-a", a.Addr().String()); err != nil {
+		f.Status = Fail
+		f.Detail = err.Error()
+		f.Fix = "loopback TCP is blocked; check the local firewall"
+		return f
+	}
+	b.Broadcast(protocol.NewEnvelope("doctor-1", "doctor-b", "doctor", "global", protocol.TypeChat, "probe"))
+	select {
+	case env := <-a.Incoming():
+		if env.Payload != "probe" {
+			f.Status = Fail
+			f.Detail = "received a garbled message"
+			return f
+		}
+		f.Detail = fmt.Sprintf("linked and delivered in %s", time.Since(start).Round(100*time.Microsecond))
+	case <-time.After(timeout):
+		f.Status = Fail
+		f.Detail = "linked, but the message never arrived"
+		f.Fix = "please report this as a bug"
+	}
+	return f
+}
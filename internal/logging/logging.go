@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"ephemeral/internal/config"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// levelOff is above every level the code logs at.
+const levelOff = slog.LevelError + 4
+
+// ParseLevel maps a configured level name to a slog level.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "off", "none":
+		return levelOff, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn, error or off)", name)
+}
+
+// Path is the file logs are appended to when they may touch disk:
+// ephemeral/ephemeral.log under $XDG_STATE_HOME (~/.local/state by
+// default).
+func Path() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "ephemeral", "ephemeral.log"), nil
+}
+
+// Setup sends log output at cfg's level to console and, unless logs are
+// ephemeral, also to the file at Path. The returned func closes that file.
+func Setup(cfg config.LoggingConfig, console io.Writer) (func(), error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	w, closeFile := console, func() {}
+	if !cfg.EphemeralLogs {
+		path, err := Path()
+		if err != nil {
+			return nil, fmt.Errorf("cannot locate log file: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w, closeFile = io.MultiWriter(console, f), func() { f.Close() }
+	}
+	log.SetOutput(w)
+	slog.SetLogLoggerLevel(level)
+	return closeFile, nil
+}
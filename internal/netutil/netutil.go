@@ -0,0 +1,176 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Scope restricts the interfaces and addresses the transport binds to and
+// discovery advertises on. The zero Scope means every interface.
+type Scope struct {
+	// Interfaces, if set, limits binding, announcing and listening for
+	// announcements to these interfaces.
+	Interfaces []net.Interface
+	// IPs, if set, are the only addresses the transport listens on and
+	// discovery advertises.
+	IPs []net.IPAddr
+}
+
+// NewScope resolves listen addresses (IP literals, link-local IPv6 ones
+// with a %zone) and interface names into a Scope.
+func NewScope(listen, ifaces []string) (Scope, error) {
+	var s Scope
+	for _, name := range ifaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return Scope{}, fmt.Errorf("interface %s: %w", name, err)
+		}
+		s.Interfaces = append(s.Interfaces, *iface)
+	}
+	for _, addr := range listen {
+		host, zone, _ := strings.Cut(addr, "%")
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if ip == nil {
+			return Scope{}, fmt.Errorf("listen address %s: not an IP address", addr)
+		}
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() && zone == "" {
+			return Scope{}, fmt.Errorf("listen address %s: link-local IPv6 needs a %%zone", addr)
+		}
+		s.IPs = append(s.IPs, net.IPAddr{IP: ip, Zone: zone})
+	}
+	return s, nil
+}
+
+// All reports whether s leaves every interface and address in play.
+func (s Scope) All() bool {
+	return len(s.Interfaces) == 0 && len(s.IPs) == 0
+}
+
+// Addrs returns the addresses we are reachable on: the listen addresses if
+// any were given, otherwise every unicast address of the selected (or, by
+// default, all non-loopback) interfaces that are up. Link-local IPv6
+// addresses carry their interface as the zone.
+func (s Scope) Addrs() []net.IPAddr {
+	if len(s.IPs) > 0 {
+		return s.IPs
+	}
+	var out []net.IPAddr
+	for _, iface := range s.interfaces() {
+		if len(s.Interfaces) == 0 && iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsMulticast() {
+				continue
+			}
+			addr := net.IPAddr{IP: ipnet.IP}
+			if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				addr.Zone = iface.Name
+			}
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// ListenAddrs returns the host:port addresses the transport should listen
+// on. The zero Scope listens on the wildcard address.
+func (s Scope) ListenAddrs(port int) []string {
+	p := strconv.Itoa(port)
+	if s.All() {
+		return []string{":" + p}
+	}
+	var out []string
+	for _, a := range s.Addrs() {
+		out = append(out, net.JoinHostPort(a.String(), p))
+	}
+	return out
+}
+
+// MulticastInterfaces returns the selected interfaces that are up,
+// multicast-capable and have an IPv6 address, i.e. the ones IPv6 discovery
+// can use.
+func (s Scope) MulticastInterfaces() []net.Interface {
+	var out []net.Interface
+	for _, iface := range s.interfaces() {
+		if iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil {
+				out = append(out, iface)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Nets returns the IPv4 and IPv6 subnets of the selected interfaces, or nil
+// when no interface was selected.
+func (s Scope) Nets() []*net.IPNet {
+	var out []*net.IPNet
+	for _, iface := range s.Interfaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				out = append(out, ipnet)
+			}
+		}
+	}
+	return out
+}
+
+// Contains reports whether ip is on one of the selected interfaces' subnets.
+// Without an interface restriction every address is.
+func (s Scope) Contains(ip net.IP) bool {
+	if len(s.Interfaces) == 0 {
+		return true
+	}
+	for _, n := range s.Nets() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaces returns the selected interfaces, or every interface, that are
+// up.
+func (s Scope) interfaces() []net.Interface {
+	ifaces := s.Interfaces
+	if len(ifaces) == 0 {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil
+		}
+	}
+	var out []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 {
+			out = append(out, iface)
+		}
+	}
+	return out
+}
+
+// Broadcast returns the directed broadcast address of an IPv4 subnet.
+func Broadcast(n *net.IPNet) net.IP {
+	ip := n.IP.To4()
+	if ip == nil || len(n.Mask) != net.IPv4len {
+		return nil
+	}
+	out := make(net.IP, net.IPv4len)
+	for i := range ip {
+		out[i] = ip[i] | ^n.Mask[i]
+	}
+	return out
+}
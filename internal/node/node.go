@@ -0,0 +1,305 @@
+package node
+
+import (
+	"ephemeral/internal/discovery"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transfer"
+	"ephemeral/internal/transport"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before further events are dropped for it.
+const subscriberBuffer = 256
+
+type EventKind int
+
+const (
+	// Message: a chat message, ours or a peer's, was added to a room.
+	Message EventKind = iota
+	PeerUp
+	PeerDown
+	// RoomsChanged: we joined or left a room.
+	RoomsChanged
+	// Dropped: Count events were dropped because the subscriber fell
+	// behind. It is delivered before the next event that fits.
+	Dropped
+)
+
+type Event struct {
+	Kind EventKind
+	// Message is the opened envelope for Message events. Synced marks
+	// messages that arrived in a backlog sync rather than live.
+	Message protocol.Envelope
+	Synced  bool
+	// Peer is the transport event for PeerUp and PeerDown.
+	Peer transport.PeerEvent
+	// Count is the number of events lost, for Dropped.
+	Count int
+}
+
+// Node ties a transport, discovery and a room manager together: it opens
+// and stores incoming chat, answers backlog syncs, dials discovered peers
+// and hands file frames to the transfer manager. Front ends (the TUI, the
+// web gateway) drive it and watch its events instead of the transport.
+type Node struct {
+	Rooms     *room.Manager
+	Transport transport.Transport
+	// Discovery and Transfers are optional; without Transfers, file offers
+	// are declined.
+	Discovery *discovery.Service
+	Transfers *transfer.Manager
+
+	mu sync.Mutex
+	// subs maps each subscriber to the events it has missed since the
+	// last Dropped it received.
+	subs map[chan Event]int
+	done chan struct{}
+	once sync.Once
+}
+
+func New(rm *room.Manager, tr transport.Transport, disc *discovery.Service, xfer *transfer.Manager) *Node {
+	return &Node{
+		Rooms:     rm,
+		Transport: tr,
+		Discovery: disc,
+		Transfers: xfer,
+		subs:      make(map[chan Event]int),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start begins consuming the transport's incoming envelopes and peer
+// events. The transport must already be started.
+func (n *Node) Start() {
+	go n.readLoop()
+	if n.Discovery != nil {
+		go n.dialLoop()
+	}
+}
+
+func (n *Node) Stop() {
+	n.once.Do(func() { close(n.done) })
+}
+
+// Subscribe returns a channel of node events and a function that ends the
+// subscription. A subscriber that falls behind misses events rather than
+// stalling the node, and is told how many with a Dropped event.
+func (n *Node) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	n.mu.Lock()
+	n.subs[ch] = 0
+	n.mu.Unlock()
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.subs[ch]; ok {
+			delete(n.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (n *Node) emit(ev Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch, missed := range n.subs {
+		if missed > 0 {
+			select {
+			case ch <- Event{Kind: Dropped, Count: missed}:
+			default:
+				n.subs[ch]++
+				continue
+			}
+		}
+		select {
+		case ch <- ev:
+			n.subs[ch] = 0
+		default:
+			n.subs[ch] = 1
+		}
+	}
+}
+
+// Join joins roomName, with a key derived from password if it is not
+// empty, subscribes to its traffic and asks peers for its backlog. The
+// current room is left as it is; switching is up to the UI.
+func (n *Node) Join(roomName, password string) error {
+	if roomName == "" {
+		return errors.New("room name is empty")
+	}
+	if password != "" {
+		key, err := room.RoomKey(roomName, password)
+		if err != nil {
+			return fmt.Errorf("cannot derive key for %s: %w", roomName, err)
+		}
+		n.Rooms.Join(roomName, true, key)
+	} else {
+		n.Rooms.Join(roomName, false, nil)
+	}
+	n.Transport.Subscribe(roomName)
+	n.requestBacklog(roomName)
+	n.emit(Event{Kind: RoomsChanged})
+	return nil
+}
+
+// Leave leaves roomName; the global room cannot be left.
+func (n *Node) Leave(roomName string) bool {
+	if !n.Rooms.Leave(roomName) {
+		return false
+	}
+	n.Transport.Unsubscribe(roomName)
+	n.emit(Event{Kind: RoomsChanged})
+	return true
+}
+
+// Say sends text to roomName, sealed with its key if it has one, and
+// returns the message as stored locally.
+func (n *Node) Say(roomName, text string) (protocol.Envelope, error) {
+	return n.say(roomName, text, false)
+}
+
+// SayAsBot is Say for a bot's reply: the message is marked so that other
+// bots ignore it.
+func (n *Node) SayAsBot(roomName, text string) (protocol.Envelope, error) {
+	return n.say(roomName, text, true)
+}
+
+func (n *Node) say(roomName, text string, bot bool) (protocol.Envelope, error) {
+	if !n.Rooms.Joined(roomName) {
+		return protocol.Envelope{}, fmt.Errorf("not in room %s", roomName)
+	}
+	env := protocol.NewEnvelope(n.newID(), n.Rooms.PeerID, n.Rooms.Nick(), roomName, protocol.TypeChat, text)
+	env.Clock = n.Rooms.Tick()
+	env.Bot = bot
+	sealed, err := n.Rooms.Seal(env)
+	if err != nil {
+		return env, err
+	}
+	if n.Rooms.AddMessage(env) {
+		n.emit(Event{Kind: Message, Message: env})
+	}
+	n.Transport.Broadcast(sealed)
+	return env, nil
+}
+
+// Notice adds a local system line to roomName.
+func (n *Node) Notice(roomName, text string) {
+	env := protocol.NewEnvelope(fmt.Sprintf("sys-%d", time.Now().UnixNano()), "system", "System", roomName, protocol.TypeChat, text)
+	if n.Rooms.AddMessage(env) {
+		n.emit(Event{Kind: Message, Message: env})
+	}
+}
+
+func (n *Node) newID() string {
+	return fmt.Sprintf("%s-%d", n.Rooms.PeerID, time.Now().UnixNano())
+}
+
+func (n *Node) readLoop() {
+	for {
+		select {
+		case env := <-n.Transport.Incoming():
+			n.handle(env)
+		case ev := <-n.Transport.Events():
+			n.peerEvent(ev)
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Node) dialLoop() {
+	for {
+		select {
+		case p := <-n.Discovery.Peers():
+			go n.Transport.Dial(p.ID, p.DialAddrs()...)
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Node) handle(env protocol.Envelope) {
+	switch env.Type {
+	case protocol.TypeChat:
+		// Messages we cannot open (wrong password, plaintext in an
+		// encrypted room) are dropped.
+		opened, err := n.Rooms.Open(env)
+		if err == nil && n.Rooms.AddMessage(opened) {
+			n.emit(Event{Kind: Message, Message: opened})
+		}
+	case protocol.TypeControl:
+		n.handleSync(env)
+	case protocol.TypeFile:
+		if n.Transfers != nil {
+			n.Transfers.Handle(env)
+		} else {
+			transfer.Decline(n.Transport, n.Rooms, env)
+		}
+	}
+}
+
+func (n *Node) peerEvent(ev transport.PeerEvent) {
+	switch ev.Type {
+	case transport.PeerUp:
+		n.Rooms.Observe(ev.Clock)
+		if n.Transfers != nil {
+			go n.Transfers.PeerUp(ev.ID)
+		}
+		n.emit(Event{Kind: PeerUp, Peer: ev})
+	case transport.PeerDown:
+		if ev.Left {
+			n.peerLeft(ev)
+		}
+		n.emit(Event{Kind: PeerDown, Peer: ev})
+	}
+}
+
+// peerLeft announces a departed peer in every joined room it was in.
+func (n *Node) peerLeft(ev transport.PeerEvent) {
+	name := ev.Nick
+	if name == "" {
+		name = ev.ID
+	}
+	all := slices.Contains(ev.Rooms, protocol.AllRooms)
+	for _, r := range n.Rooms.Names() {
+		if all || slices.Contains(ev.Rooms, r) {
+			n.Notice(r, fmt.Sprintf("%s left", name))
+		}
+	}
+}
+
+// requestBacklog asks every connected peer for the recent messages of a
+// room we just joined; members answer with a sync reply.
+func (n *Node) requestBacklog(roomName string) {
+	n.Transport.Broadcast(protocol.NewControl(n.newID(), n.Rooms.PeerID, n.Rooms.Nick(),
+		protocol.Control{Op: protocol.ControlSync, Rooms: []string{roomName}}))
+}
+
+// handleSync answers backlog requests for rooms we are in and merges the
+// replies to our own.
+func (n *Node) handleSync(env protocol.Envelope) {
+	c, err := protocol.ParseControl(env)
+	if err != nil || len(c.Rooms) != 1 || env.Via == "" {
+		return
+	}
+	switch c.Op {
+	case protocol.ControlSync:
+		envs, ok := n.Rooms.Backlog(c.Rooms[0])
+		if !ok || len(envs) == 0 {
+			return
+		}
+		go n.Transport.Send(env.Via, protocol.NewControl(n.newID(), n.Rooms.PeerID, n.Rooms.Nick(),
+			protocol.Control{Op: protocol.ControlSyncReply, Rooms: c.Rooms, Envelopes: envs, Clock: n.Rooms.Clock()}))
+	case protocol.ControlSyncReply:
+		n.Rooms.Observe(c.Clock)
+		for _, m := range n.Rooms.MergeBacklog(c.Rooms[0], c.Envelopes) {
+			n.emit(Event{Kind: Message, Message: m, Synced: true})
+		}
+	}
+}
@@ -0,0 +1,713 @@
+package overlay
+
+import (
+	"context"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Mode selects how room traffic is disseminated.
+type Mode string
+
+const (
+	// ModeMesh connects to every discovered peer and sends each message
+	// straight to all of them.
+	ModeMesh Mode = "mesh"
+	// ModeGossip keeps a bounded active view and relays messages along an
+	// epidemic broadcast tree.
+	ModeGossip Mode = "gossip"
+	// ModeAuto behaves like ModeMesh until more than MeshThreshold peers are
+	// known and like ModeGossip afterwards.
+	ModeAuto Mode = "auto"
+)
+
+type Config struct {
+	Mode          Mode
+	ActiveSize    int
+	PassiveSize   int
+	MeshThreshold int
+	// GraftTimeout is how long an announced but missing message may stay
+	// missing before it is pulled from the peer that announced it.
+	GraftTimeout    time.Duration
+	ShuffleInterval time.Duration
+	CacheSize       int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Mode:            ModeAuto,
+		ActiveSize:      6,
+		PassiveSize:     40,
+		MeshThreshold:   32,
+		GraftTimeout:    500 * time.Millisecond,
+		ShuffleInterval: 30 * time.Second,
+		CacheSize:       1000,
+	}
+}
+
+// Gossip is a Transport that layers a HyParView-style membership (small
+// active view, larger passive view) and Plumtree-style dissemination (eager
+// push along a tree, lazy IHAVE announcements to repair it) over another
+// Transport.
+//
+// To keep the overlay from splitting into isolated cliques, every node also
+// holds a pinned link to its successor in peer-ID order, so the active views
+// always contain a ring over all known peers.
+type Gossip struct {
+	inner transport.Transport
+	cfg   Config
+	id    string
+	nick  string
+
+	mu     sync.Mutex
+	active map[string]bool
+	eager  map[string]bool
+	// pinned peers asked for a high-priority link (ring neighbours, peers
+	// with an empty view) or are static, and are never evicted.
+	pinned map[string]bool
+	// passive is the address book of every dialable peer we know of; the
+	// ones not in the active view form the HyParView passive view.
+	passive map[string][]string
+	seen    map[string]bool
+	order   []string
+	cache   map[string]protocol.Envelope
+	missing map[string]*missing
+	// gossipers are peers that sent neighbor, prune or shuffle, which
+	// only gossiping nodes do. What they push us may not have reached
+	// everyone, so a mesh-mode node forwards it.
+	gossipers map[string]bool
+	// forwarding is set while we subscribe to every room on the inner
+	// transport, because we forward traffic for rooms we are not in.
+	forwarding bool
+
+	incomingCh chan protocol.Envelope
+	eventCh    chan transport.PeerEvent
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// maxAnnouncers bounds how many peers are remembered as able to repair
+// one missing message.
+const maxAnnouncers = 4
+
+// missing is a message announced by IHAVE that has not arrived. It is
+// pulled from the next announcer at due, and forgotten at expires or once
+// every announcer was tried.
+type missing struct {
+	announcers []string
+	due        time.Time
+	expires    time.Time
+}
+
+var _ transport.Transport = (*Gossip)(nil)
+
+func New(inner transport.Transport, id, nick string, cfg Config) *Gossip {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Gossip{
+		inner:      inner,
+		cfg:        cfg,
+		id:         id,
+		nick:       nick,
+		active:     make(map[string]bool),
+		eager:      make(map[string]bool),
+		pinned:     make(map[string]bool),
+		passive:    make(map[string][]string),
+		seen:       make(map[string]bool),
+		cache:      make(map[string]protocol.Envelope),
+		missing:    make(map[string]*missing),
+		gossipers:  make(map[string]bool),
+		incomingCh: make(chan protocol.Envelope, 100),
+		eventCh:    make(chan transport.PeerEvent, 100),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (g *Gossip) Start() error {
+	if err := g.inner.Start(); err != nil {
+		return err
+	}
+	g.updateForwarding()
+	go g.loop()
+	go g.maintain()
+	go g.repair()
+	return nil
+}
+
+func (g *Gossip) Stop() {
+	g.cancel()
+	g.inner.Stop()
+}
+
+// gossiping reports whether the overlay is currently bounding its view.
+// Callers must hold g.mu.
+func (g *Gossip) gossiping() bool {
+	switch g.cfg.Mode {
+	case ModeGossip:
+		return true
+	case ModeAuto:
+		known := len(g.passive)
+		for id := range g.active {
+			if _, ok := g.passive[id]; !ok {
+				known++
+			}
+		}
+		return known > g.cfg.MeshThreshold
+	}
+	return false
+}
+
+// Dial connects to a discovered peer, or parks it in the passive view when
+// the active view is already full.
+func (g *Gossip) Dial(peerID string, addrs ...string) error {
+	g.mu.Lock()
+	if peerID != "" && g.active[peerID] {
+		g.mu.Unlock()
+		return nil
+	}
+	succ := ""
+	if peerID != "" {
+		g.addPassive(peerID, addrs)
+		succ = g.successor()
+		if g.gossiping() && len(g.active) >= g.cfg.ActiveSize && peerID != succ {
+			g.mu.Unlock()
+			return nil
+		}
+	}
+	high := len(g.active) == 0 || peerID == succ
+	gossip := g.gossiping()
+	g.mu.Unlock()
+
+	if err := g.inner.Dial(peerID, addrs...); err != nil {
+		g.mu.Lock()
+		delete(g.passive, peerID)
+		g.mu.Unlock()
+		return err
+	}
+	if gossip && peerID != "" {
+		g.sendControl(peerID, protocol.Control{Op: protocol.ControlNeighbor, High: high})
+	}
+	return nil
+}
+
+func (g *Gossip) Send(peerID string, env protocol.Envelope) error {
+	return g.inner.Send(peerID, env)
+}
+
+// Broadcast disseminates one of our own envelopes: straight to every peer
+// in mesh mode, along the broadcast tree in gossip mode.
+func (g *Gossip) Broadcast(env protocol.Envelope) {
+	if !disseminated(env) {
+		g.inner.Broadcast(env)
+		return
+	}
+
+	wants := g.subscribers(env)
+	g.mu.Lock()
+	g.remember(env)
+	if !g.gossiping() {
+		g.mu.Unlock()
+		g.inner.Broadcast(env)
+		return
+	}
+	eager, lazy := g.targets("", env.From, wants)
+	g.mu.Unlock()
+
+	g.push(env, eager, lazy)
+}
+
+func (g *Gossip) Disconnect(peerID string) {
+	g.inner.Disconnect(peerID)
+}
+
+// Persist is passed through; static peers are pinned into the active view
+// when they come up so maintain never evicts them.
+func (g *Gossip) Persist(addr string) { g.inner.Persist(addr) }
+
+// Subscribe is passed through for room routing. While gossiping we also
+// subscribe to every room, since we forward traffic for rooms we are not
+// in; the application filters what it displays.
+func (g *Gossip) Subscribe(room string)   { g.inner.Subscribe(room) }
+func (g *Gossip) Unsubscribe(room string) { g.inner.Unsubscribe(room) }
+
+func (g *Gossip) Incoming() <-chan protocol.Envelope { return g.incomingCh }
+func (g *Gossip) Events() <-chan transport.PeerEvent { return g.eventCh }
+func (g *Gossip) Addr() net.Addr                     { return g.inner.Addr() }
+func (g *Gossip) Peers() []transport.PeerInfo        { return g.inner.Peers() }
+func (g *Gossip) Ping(peerID string) error           { return g.inner.Ping(peerID) }
+func (g *Gossip) Acks() <-chan transport.AckEvent    { return g.inner.Acks() }
+func (g *Gossip) Delivery(id string) (transport.DeliveryStatus, bool) {
+	return g.inner.Delivery(id)
+}
+
+// ActiveView lists the peers currently in the active view.
+func (g *Gossip) ActiveView() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, len(g.active))
+	for id := range g.active {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (g *Gossip) loop() {
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case ev := <-g.inner.Events():
+			g.handleEvent(ev)
+			select {
+			case g.eventCh <- ev:
+			default:
+			}
+		case env := <-g.inner.Incoming():
+			if env.Type == protocol.TypeControl && g.handleControl(env) {
+				continue
+			}
+			if disseminated(env) {
+				g.handleData(env)
+				continue
+			}
+			g.deliver(env)
+		}
+	}
+}
+
+func (g *Gossip) handleEvent(ev transport.PeerEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch ev.Type {
+	case transport.PeerUp:
+		g.active[ev.ID] = true
+		g.eager[ev.ID] = true
+		if ev.Static {
+			g.pinned[ev.ID] = true
+		}
+	case transport.PeerDown:
+		delete(g.active, ev.ID)
+		delete(g.eager, ev.ID)
+		delete(g.pinned, ev.ID)
+		delete(g.gossipers, ev.ID)
+	}
+}
+
+func (g *Gossip) handleData(env protocol.Envelope) {
+	via := env.Via
+	wants := g.subscribers(env)
+
+	g.mu.Lock()
+	if g.seen[env.ID] {
+		// A duplicate means via's branch of the tree is redundant for us.
+		prune := g.gossiping() && g.eager[via]
+		if prune {
+			delete(g.eager, via)
+		}
+		g.mu.Unlock()
+		if prune {
+			g.sendControl(via, protocol.Control{Op: protocol.ControlPrune})
+		}
+		return
+	}
+	g.remember(env)
+	delete(g.missing, env.ID)
+	if g.active[via] {
+		g.eager[via] = true
+	}
+
+	// Mesh-mode nodes only relay what a gossiping peer pushed them, since
+	// that may have reached only part of the mesh. Anything else,
+	// including what a relay forwarded, went to every subscriber already.
+	// Either way only peers in its room, or forwarding every room, get it.
+	relay := g.gossiping() || g.gossipers[via]
+	var eager, lazy []string
+	if relay {
+		eager, lazy = g.targets(via, env.From, wants)
+	}
+	g.mu.Unlock()
+
+	g.deliver(env)
+	if relay {
+		g.push(env, eager, lazy)
+	}
+}
+
+func (g *Gossip) handleControl(env protocol.Envelope) bool {
+	c, err := protocol.ParseControl(env)
+	if err != nil {
+		return false
+	}
+	from := env.Via
+
+	switch c.Op {
+	case protocol.ControlIHave:
+		g.mu.Lock()
+		now := time.Now()
+		for _, id := range c.IDs {
+			if g.seen[id] {
+				continue
+			}
+			m, ok := g.missing[id]
+			if !ok {
+				// A full table means we are flooded with announcements;
+				// the eager tree still delivers, so drop the surplus.
+				if len(g.missing) >= g.cfg.CacheSize {
+					continue
+				}
+				m = &missing{
+					due:     now.Add(g.cfg.GraftTimeout),
+					expires: now.Add(maxAnnouncers * 2 * g.cfg.GraftTimeout),
+				}
+				g.missing[id] = m
+			}
+			if len(m.announcers) < maxAnnouncers && !slices.Contains(m.announcers, from) {
+				m.announcers = append(m.announcers, from)
+			}
+		}
+		g.mu.Unlock()
+
+	case protocol.ControlGraft:
+		g.mu.Lock()
+		if g.active[from] {
+			g.eager[from] = true
+		}
+		var envs []protocol.Envelope
+		for _, id := range c.IDs {
+			if cached, ok := g.cache[id]; ok {
+				envs = append(envs, cached)
+			}
+		}
+		g.mu.Unlock()
+		for _, e := range envs {
+			g.inner.Send(from, e)
+		}
+
+	case protocol.ControlPrune:
+		g.mu.Lock()
+		delete(g.eager, from)
+		g.gossipers[from] = true
+		g.mu.Unlock()
+
+	case protocol.ControlNeighbor:
+		g.mu.Lock()
+		g.active[from] = true
+		g.gossipers[from] = true
+		if c.High {
+			g.pinned[from] = true
+		}
+		accept := c.High || len(g.active) <= g.cfg.ActiveSize || !g.gossiping()
+		var evict string
+		if accept && g.gossiping() && len(g.active) > g.cfg.ActiveSize {
+			evict = g.evictable(from)
+		}
+		g.mu.Unlock()
+		if !accept {
+			g.drop(from)
+		} else if evict != "" {
+			g.drop(evict)
+		}
+
+	case protocol.ControlDisconnect:
+		g.inner.Disconnect(from)
+
+	case protocol.ControlShuffle, protocol.ControlShuffleReply:
+		g.mu.Lock()
+		if c.Op == protocol.ControlShuffle {
+			g.gossipers[from] = true
+		}
+		for id, addrs := range c.Peers {
+			if id != g.id && !g.active[id] {
+				g.addPassive(id, addrs)
+			}
+		}
+		var sample map[string][]string
+		if c.Op == protocol.ControlShuffle {
+			sample = g.samplePassive(len(c.Peers))
+		}
+		g.mu.Unlock()
+		if sample != nil {
+			g.sendControl(from, protocol.Control{Op: protocol.ControlShuffleReply, Peers: sample})
+		}
+
+	default:
+		return false
+	}
+	return true
+}
+
+// repair pulls messages that were announced but never arrived, trying each
+// announcer in turn and promoting it back into the eager set. One loop
+// serves the whole missing table, so announcements cost no goroutines.
+func (g *Gossip) repair() {
+	ticker := time.NewTicker(g.cfg.GraftTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		type graft struct{ peer, id string }
+		var grafts []graft
+		now := time.Now()
+		g.mu.Lock()
+		for id, m := range g.missing {
+			if now.Before(m.due) {
+				continue
+			}
+			if g.seen[id] || len(m.announcers) == 0 || now.After(m.expires) {
+				delete(g.missing, id)
+				continue
+			}
+			peer := m.announcers[0]
+			m.announcers = m.announcers[1:]
+			m.due = now.Add(g.cfg.GraftTimeout)
+			if g.active[peer] {
+				g.eager[peer] = true
+			}
+			grafts = append(grafts, graft{peer, id})
+		}
+		g.mu.Unlock()
+
+		for _, gr := range grafts {
+			g.sendControl(gr.peer, protocol.Control{Op: protocol.ControlGraft, IDs: []string{gr.id}})
+		}
+	}
+}
+
+// maintain refills the active view from the passive view, trims it when it
+// overflows and periodically swaps passive entries with a neighbour.
+func (g *Gossip) maintain() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastShuffle := time.Now()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		g.mu.Lock()
+		var promote, evict, shuffleTo string
+		var promoteAddrs []string
+		var sample map[string][]string
+		gossip := g.gossiping()
+		if succ := g.successor(); gossip && succ != "" && !g.active[succ] {
+			promote, promoteAddrs = succ, g.passive[succ]
+		} else if len(g.active) < g.cfg.ActiveSize || !gossip {
+			for id, addrs := range g.passive {
+				if !g.active[id] {
+					promote, promoteAddrs = id, addrs
+					break
+				}
+			}
+		}
+		if gossip && len(g.active) > g.cfg.ActiveSize {
+			evict = g.evictable("")
+		}
+		if gossip && time.Since(lastShuffle) > g.cfg.ShuffleInterval {
+			lastShuffle = time.Now()
+			shuffleTo = g.randomActive("")
+			sample = g.samplePassive(g.cfg.ActiveSize)
+		}
+		g.mu.Unlock()
+
+		g.updateForwarding()
+		if promote != "" {
+			go g.Dial(promote, promoteAddrs...)
+		}
+		if evict != "" {
+			g.drop(evict)
+		}
+		if shuffleTo != "" && len(sample) > 0 {
+			g.sendControl(shuffleTo, protocol.Control{Op: protocol.ControlShuffle, Peers: sample})
+		}
+	}
+}
+
+// drop moves peer from the active to the passive view and tells it to do
+// the same, so neither side tries to restore the link.
+func (g *Gossip) drop(peer string) {
+	g.sendControl(peer, protocol.Control{Op: protocol.ControlDisconnect})
+	g.inner.Disconnect(peer)
+}
+
+func (g *Gossip) push(env protocol.Envelope, eager, lazy []string) {
+	for _, p := range eager {
+		go g.inner.Send(p, env)
+	}
+	for _, p := range lazy {
+		go g.sendControl(p, protocol.Control{Op: protocol.ControlIHave, IDs: []string{env.ID}})
+	}
+}
+
+// updateForwarding subscribes to every room on the inner transport while
+// we gossip, and drops that subscription when we fall back to the mesh.
+func (g *Gossip) updateForwarding() {
+	g.mu.Lock()
+	want := g.gossiping()
+	changed := want != g.forwarding
+	g.forwarding = want
+	g.mu.Unlock()
+	switch {
+	case changed && want:
+		g.inner.Subscribe(protocol.AllRooms)
+	case changed:
+		g.inner.Unsubscribe(protocol.AllRooms)
+	}
+}
+
+// subscribers reports which peers want env: for chat, those subscribed to
+// its room or to every room, which includes gossiping forwarders; for
+// anything else, everyone.
+func (g *Gossip) subscribers(env protocol.Envelope) func(peer string) bool {
+	if env.Type != protocol.TypeChat || env.Room == "" {
+		return everyone
+	}
+	subs := make(map[string]bool)
+	for _, p := range g.inner.Peers() {
+		if slices.Contains(p.Rooms, env.Room) || slices.Contains(p.Rooms, protocol.AllRooms) {
+			subs[p.ID] = true
+		}
+	}
+	return func(peer string) bool { return subs[peer] }
+}
+
+func everyone(string) bool { return true }
+
+// targets splits the active peers that want a message into eager and lazy
+// recipients, leaving out the peer it came from and its origin. Callers
+// must hold g.mu.
+func (g *Gossip) targets(via, origin string, wants func(string) bool) (eager, lazy []string) {
+	for id := range g.active {
+		if id == via || id == origin || !wants(id) {
+			continue
+		}
+		if g.eager[id] {
+			eager = append(eager, id)
+		} else {
+			lazy = append(lazy, id)
+		}
+	}
+	return eager, lazy
+}
+
+// remember marks env as seen and caches it for grafts. Callers must hold g.mu.
+func (g *Gossip) remember(env protocol.Envelope) {
+	env.Via = ""
+	g.seen[env.ID] = true
+	g.cache[env.ID] = env
+	g.order = append(g.order, env.ID)
+	if len(g.order) > g.cfg.CacheSize {
+		for _, id := range g.order[:len(g.order)-g.cfg.CacheSize] {
+			delete(g.seen, id)
+			delete(g.cache, id)
+		}
+		g.order = g.order[len(g.order)-g.cfg.CacheSize:]
+	}
+}
+
+// addPassive records a dialable peer, evicting a random entry when the
+// passive view is full. Callers must hold g.mu.
+func (g *Gossip) addPassive(id string, addrs []string) {
+	if id == g.id || len(addrs) == 0 {
+		return
+	}
+	if _, ok := g.passive[id]; !ok && len(g.passive) >= g.cfg.PassiveSize {
+		for victim := range g.passive {
+			delete(g.passive, victim)
+			break
+		}
+	}
+	g.passive[id] = addrs
+}
+
+// samplePassive picks up to n passive entries. Callers must hold g.mu.
+func (g *Gossip) samplePassive(n int) map[string][]string {
+	sample := make(map[string][]string, n)
+	for id, addrs := range g.passive {
+		if len(sample) >= n {
+			break
+		}
+		sample[id] = addrs
+	}
+	return sample
+}
+
+// successor is the known peer whose ID follows ours, wrapping around.
+// Callers must hold g.mu.
+func (g *Gossip) successor() string {
+	var next, first string
+	for id := range g.passive {
+		if first == "" || id < first {
+			first = id
+		}
+		if id > g.id && (next == "" || id < next) {
+			next = id
+		}
+	}
+	if next == "" {
+		return first
+	}
+	return next
+}
+
+// evictable picks a random active peer that may be dropped to make room.
+// Callers must hold g.mu.
+func (g *Gossip) evictable(except string) string {
+	succ := g.successor()
+	ids := make([]string, 0, len(g.active))
+	for id := range g.active {
+		if id != except && id != succ && !g.pinned[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[rand.Intn(len(ids))]
+}
+
+// randomActive picks an active peer other than except. Callers must hold g.mu.
+func (g *Gossip) randomActive(except string) string {
+	ids := make([]string, 0, len(g.active))
+	for id := range g.active {
+		if id != except {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[rand.Intn(len(ids))]
+}
+
+func (g *Gossip) sendControl(peer string, c protocol.Control) {
+	env := protocol.NewControl(fmt.Sprintf("%s-%d", g.id, time.Now().UnixNano()), g.id, g.nick, c)
+	g.inner.Send(peer, env)
+}
+
+func (g *Gossip) deliver(env protocol.Envelope) {
+	select {
+	case g.incomingCh <- env:
+	case <-g.ctx.Done():
+	}
+}
+
+// disseminated reports whether env is room traffic that travels the overlay
+// rather than a link-local message.
+func disseminated(env protocol.Envelope) bool {
+	return env.ID != "" && (env.Type == protocol.TypeChat || env.Type == protocol.TypePresence)
+}
@@ -0,0 +1,127 @@
+package pipe
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxBytes keeps a batch, sealed and wrapped in its envelope,
+	// within the 4 KiB message limit.
+	DefaultMaxBytes = 2048
+	DefaultInterval = time.Second
+
+	// lineBacklog is how many read lines may wait for a post before
+	// reading stalls, pushing back on the writer.
+	lineBacklog = 1024
+)
+
+// Pump posts the lines of a stream in batches: lines read within one
+// Interval are joined into one post of at most MaxBytes, and posts are at
+// least Interval apart. Longer lines are split.
+type Pump struct {
+	MaxBytes int
+	Interval time.Duration
+	Post     func(text string) error
+
+	batch []string
+	size  int
+	last  time.Time
+}
+
+func New(post func(text string) error) *Pump {
+	return &Pump{MaxBytes: DefaultMaxBytes, Interval: DefaultInterval, Post: post}
+}
+
+// Run pumps r until EOF, posting whatever is left before returning. It
+// stops early if a post fails.
+func (p *Pump) Run(r io.Reader) error {
+	if p.MaxBytes <= 0 {
+		p.MaxBytes = DefaultMaxBytes
+	}
+	if p.Interval <= 0 {
+		p.Interval = DefaultInterval
+	}
+	lines := make(chan string, lineBacklog)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				lines <- line
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	tick := time.NewTicker(p.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := p.flush(); err != nil {
+					return err
+				}
+				return <-readErr
+			}
+			for _, part := range split(line, p.MaxBytes) {
+				if p.size > 0 && p.size+1+len(part) > p.MaxBytes {
+					if err := p.flush(); err != nil {
+						return err
+					}
+				}
+				p.batch = append(p.batch, part)
+				p.size += len(part) + 1
+			}
+		case <-tick.C:
+			if err := p.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush posts the pending batch, first waiting out the rate limit.
+func (p *Pump) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	if wait := time.Until(p.last.Add(p.Interval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	text := strings.Join(p.batch, "\n")
+	p.batch, p.size = p.batch[:0], 0
+	p.last = time.Now()
+	return p.Post(text)
+}
+
+// split cuts line into pieces of at most max bytes without breaking a
+// UTF-8 sequence.
+func split(line string, max int) []string {
+	var parts []string
+	for len(line) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = max
+		}
+		parts = append(parts, line[:cut])
+		line = line[cut:]
+	}
+	return append(parts, line)
+}
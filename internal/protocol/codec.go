@@ -0,0 +1,371 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Codec names, in the form they are negotiated in the hello.
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary"
+)
+
+// MaxFrameSize bounds a single binary frame so a corrupt or hostile length
+// prefix cannot make the reader allocate without limit.
+const MaxFrameSize = 16 << 20
+
+// Codec frames envelopes on a stream. The handshake is always JSON; the
+// codec agreed on in it is used for everything after.
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+	// Marshal returns env's complete frame, exactly as an Encoder would
+	// write it, so one encoding can be shared by many connections. The
+	// result must not be modified.
+	Marshal(env Envelope) ([]byte, error)
+}
+
+type Encoder interface {
+	Encode(env Envelope) error
+}
+
+type Decoder interface {
+	Decode(env *Envelope) error
+}
+
+var codecs = map[string]Codec{
+	CodecJSON:   JSON,
+	CodecBinary: Binary,
+}
+
+// CodecByName looks up a codec by its negotiated name.
+func CodecByName(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// ChooseCodec picks the first of the offered codec names we support, or
+// JSON when there is none (peers that predate negotiation offer nothing).
+func ChooseCodec(offered []string) Codec {
+	for _, name := range offered {
+		if c, ok := codecs[name]; ok {
+			return c
+		}
+	}
+	return JSON
+}
+
+// JSON is the JSON-Lines codec: readable with netcat, and the default.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return jsonEncoder{json.NewEncoder(w)} }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return jsonDecoder{json.NewDecoder(r)} }
+
+func (jsonCodec) Marshal(env Envelope) ([]byte, error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+type jsonEncoder struct{ enc *json.Encoder }
+
+func (e jsonEncoder) Encode(env Envelope) error { return e.enc.Encode(env) }
+
+type jsonDecoder struct{ dec *json.Decoder }
+
+func (d jsonDecoder) Decode(env *Envelope) error { return d.dec.Decode(env) }
+
+// Buffered returns the bytes the decoder has read past the last envelope,
+// which belong to whatever codec the stream switches to.
+func (d jsonDecoder) Buffered() io.Reader { return d.dec.Buffered() }
+
+// Switch continues a stream in codec c after a JSON handshake read with
+// dec, keeping any bytes dec had already buffered and dropping the newline
+// that ends the last JSON line.
+func Switch(c Codec, dec Decoder, r io.Reader) Decoder {
+	if b, ok := dec.(interface{ Buffered() io.Reader }); ok {
+		r = io.MultiReader(b.Buffered(), r)
+	}
+	return c.NewDecoder(&skipNewline{r: r})
+}
+
+// skipNewline drops a leading '\n' on the first read that returns data. It
+// must not peek ahead, since nothing may follow the handshake for a while.
+type skipNewline struct {
+	r    io.Reader
+	done bool
+}
+
+func (s *skipNewline) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if !s.done && n > 0 {
+		s.done = true
+		if p[0] == '\n' {
+			n = copy(p, p[1:n])
+		}
+	}
+	return n, err
+}
+
+// Binary is a compact length-prefixed encoding of Envelope. Each frame is a
+// uvarint length followed by:
+//
+//	uvarint v, byte flags, string id, from, nick, room,
+//	varint ts, string type, bytes payload, string sig, uvarint clock
+//
+// where strings and bytes are uvarint-length-prefixed. Flag bit 0 is Enc,
+// bit 2 is Zip and bit 3 is Bot; bit 1 means the payload was base64 and travels as the
+// raw bytes, which is how sealed and compressed payloads avoid base64's
+// one-third overhead.
+var Binary Codec = binaryCodec{}
+
+const (
+	flagEnc byte = 1 << iota
+	flagRawPayload
+	flagZip
+	flagBot
+)
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return CodecBinary }
+
+func (binaryCodec) NewEncoder(w io.Writer) Encoder { return &binaryEncoder{w: w} }
+func (binaryCodec) NewDecoder(r io.Reader) Decoder {
+	return &binaryDecoder{r: bufio.NewReader(r)}
+}
+
+func (binaryCodec) Marshal(env Envelope) ([]byte, error) {
+	return AppendBinary(nil, env), nil
+}
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *binaryEncoder) Encode(env Envelope) error {
+	frame := AppendBinary(e.buf[:0], env)
+	e.buf = frame
+	_, err := e.w.Write(frame)
+	return err
+}
+
+// AppendBinary appends env's binary frame, length prefix included, to b.
+func AppendBinary(b []byte, env Envelope) []byte {
+	var flags byte
+	var raw []byte
+	if env.Enc {
+		flags |= flagEnc
+	}
+	if env.Zip {
+		flags |= flagZip
+	}
+	if env.Bot {
+		flags |= flagBot
+	}
+	if env.Enc || env.Zip {
+		// Only canonical base64 is unpacked, so decoding restores the
+		// payload byte for byte.
+		enc := base64.StdEncoding.Strict()
+		if len(env.Payload)%4 == 0 {
+			if r, err := enc.DecodeString(env.Payload); err == nil && base64.StdEncoding.EncodedLen(len(r)) == len(env.Payload) {
+				flags |= flagRawPayload
+				raw = r
+			}
+		}
+	}
+	payloadLen := len(env.Payload)
+	if raw != nil {
+		payloadLen = len(raw)
+	}
+
+	size := uvarintLen(uint64(env.V)) + 1 +
+		stringLen(env.ID) + stringLen(env.From) + stringLen(env.Nick) + stringLen(env.Room) +
+		varintLen(env.TS) + stringLen(string(env.Type)) +
+		uvarintLen(uint64(payloadLen)) + payloadLen + stringLen(env.Sig) +
+		uvarintLen(env.Clock)
+	b = slices.Grow(b, uvarintLen(uint64(size))+size)
+
+	b = binary.AppendUvarint(b, uint64(size))
+	b = binary.AppendUvarint(b, uint64(env.V))
+	b = append(b, flags)
+	b = appendString(b, env.ID)
+	b = appendString(b, env.From)
+	b = appendString(b, env.Nick)
+	b = appendString(b, env.Room)
+	b = binary.AppendVarint(b, env.TS)
+	b = appendString(b, string(env.Type))
+	b = binary.AppendUvarint(b, uint64(payloadLen))
+	if raw != nil {
+		b = append(b, raw...)
+	} else {
+		b = append(b, env.Payload...)
+	}
+	b = appendString(b, env.Sig)
+	return binary.AppendUvarint(b, env.Clock)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func varintLen(v int64) int {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+	return uvarintLen(u)
+}
+
+func stringLen(s string) int {
+	return uvarintLen(uint64(len(s))) + len(s)
+}
+
+type binaryDecoder struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (d *binaryDecoder) Decode(env *Envelope) error {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	if n > MaxFrameSize {
+		return fmt.Errorf("binary frame of %d bytes exceeds limit", n)
+	}
+	if uint64(cap(d.buf)) < n {
+		d.buf = make([]byte, n)
+	}
+	frame := d.buf[:n]
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return decodeBinary(frame, env)
+}
+
+var errShortFrame = errors.New("truncated binary frame")
+
+func decodeBinary(b []byte, env *Envelope) error {
+	r := frameReader{b: b}
+	*env = Envelope{}
+	env.V = int(r.uvarint())
+	flags := r.byte()
+	env.ID = r.string()
+	env.From = r.string()
+	env.Nick = r.string()
+	env.Room = r.string()
+	env.TS = r.varint()
+	env.Type = MessageType(r.string())
+	payload := r.bytes()
+	env.Sig = r.string()
+	// A frame may end before the clock, which then stays zero.
+	if len(r.b) > 0 {
+		env.Clock = r.uvarint()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	env.Enc = flags&flagEnc != 0
+	env.Zip = flags&flagZip != 0
+	env.Bot = flags&flagBot != 0
+	if flags&flagRawPayload != 0 {
+		env.Payload = base64.StdEncoding.EncodeToString(payload)
+	} else {
+		env.Payload = string(payload)
+	}
+	return nil
+}
+
+// frameReader walks a frame, remembering the first error so decodeBinary
+// can check once at the end.
+type frameReader struct {
+	b   []byte
+	err error
+}
+
+func (r *frameReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortFrame
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *frameReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errShortFrame
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *frameReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) == 0 {
+		r.err = errShortFrame
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *frameReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.b)) < n {
+		r.err = errShortFrame
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *frameReader) string() string {
+	return string(r.bytes())
+}
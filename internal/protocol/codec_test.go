@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+func sealedEnvelope(size int) Envelope {
+	raw := make([]byte, size)
+	rand.Read(raw)
+	env := NewEnvelope("peer1-1700000000000000000", "8c0f3a52-5d2b-4a57-9a0e-52f3f1c6a0c1", "alice", "secret", TypeChat, base64.StdEncoding.EncodeToString(raw))
+	env.Enc = true
+	return env
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	envs := []Envelope{
+		NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, "hello ✓"),
+		NewHello("peer1", "nick1", Hello{Rooms: []string{"global"}, Codecs: []string{CodecBinary}}),
+		sealedEnvelope(200),
+	}
+	// Not canonical base64: must survive unchanged rather than be unpacked.
+	odd := NewEnvelope("id2", "peer1", "nick1", "secret", TypeChat, "not base64!")
+	odd.Enc = true
+	clocked := NewEnvelope("id3", "peer1", "nick1", "global", TypeChat, "reply")
+	clocked.Clock = 1 << 40
+	clocked.Bot = true
+	envs = append(envs, odd, clocked)
+
+	for _, c := range []Codec{JSON, Binary} {
+		var buf bytes.Buffer
+		enc := c.NewEncoder(&buf)
+		for _, env := range envs {
+			if err := enc.Encode(env); err != nil {
+				t.Fatalf("%s: Encode failed: %v", c.Name(), err)
+			}
+		}
+		dec := c.NewDecoder(&buf)
+		for _, want := range envs {
+			var got Envelope
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("%s: Decode failed: %v", c.Name(), err)
+			}
+			if got != want {
+				t.Errorf("%s: got %+v, want %+v", c.Name(), got, want)
+			}
+		}
+		var extra Envelope
+		if err := dec.Decode(&extra); err != io.EOF {
+			t.Errorf("%s: expected EOF, got %v", c.Name(), err)
+		}
+	}
+}
+
+func TestBinaryIsSmallerForSealedPayloads(t *testing.T) {
+	env := sealedEnvelope(1024)
+	var j, b bytes.Buffer
+	JSON.NewEncoder(&j).Encode(env)
+	Binary.NewEncoder(&b).Encode(env)
+	if b.Len() >= j.Len()*4/5 {
+		t.Errorf("Expected binary frame well under JSON size, got %d vs %d bytes", b.Len(), j.Len())
+	}
+}
+
+func TestSwitchKeepsBufferedBytes(t *testing.T) {
+	var buf bytes.Buffer
+	JSON.NewEncoder(&buf).Encode(NewHello("peer1", "nick1", Hello{Codec: CodecBinary}))
+	Binary.NewEncoder(&buf).Encode(NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, "after switch"))
+
+	dec := JSON.NewDecoder(&buf)
+	var hello Envelope
+	if err := dec.Decode(&hello); err != nil {
+		t.Fatalf("Decode hello failed: %v", err)
+	}
+	dec = Switch(Binary, dec, &buf)
+	var env Envelope
+	if err := dec.Decode(&env); err != nil || env.Payload != "after switch" {
+		t.Fatalf("Expected the binary envelope, got %+v (%v)", env, err)
+	}
+}
+
+func TestBinaryRejectsBadFrames(t *testing.T) {
+	var buf bytes.Buffer
+	Binary.NewEncoder(&buf).Encode(NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, "hello"))
+	frame := buf.Bytes()
+
+	var env Envelope
+	if err := Binary.NewDecoder(bytes.NewReader(frame[:len(frame)-3])).Decode(&env); err == nil {
+		t.Error("Expected a truncated frame to fail")
+	}
+	// Length prefix of 1 GiB.
+	huge := []byte{0x80, 0x80, 0x80, 0x80, 0x04}
+	if err := Binary.NewDecoder(bytes.NewReader(huge)).Decode(&env); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Expected an oversized frame to be refused, got %v", err)
+	}
+}
+
+func TestMarshalMatchesEncoder(t *testing.T) {
+	env := sealedEnvelope(100)
+	for _, c := range []Codec{JSON, Binary} {
+		var buf bytes.Buffer
+		c.NewEncoder(&buf).Encode(env)
+		frame, err := c.Marshal(env)
+		if err != nil {
+			t.Fatalf("%s: Marshal failed: %v", c.Name(), err)
+		}
+		if !bytes.Equal(frame, buf.Bytes()) {
+			t.Errorf("%s: Marshal and Encode disagree", c.Name())
+		}
+	}
+}
+
+func benchmarkEncode(b *testing.B, c Codec, size int) {
+	env := sealedEnvelope(size)
+	var buf bytes.Buffer
+	enc := c.NewEncoder(&buf)
+	enc.Encode(env)
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		enc.Encode(env)
+	}
+}
+
+func benchmarkDecode(b *testing.B, c Codec, size int) {
+	var buf bytes.Buffer
+	c.NewEncoder(&buf).Encode(sealedEnvelope(size))
+	frame := buf.Bytes()
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	var env Envelope
+	for i := 0; i < b.N; i++ {
+		if err := c.NewDecoder(bytes.NewReader(frame)).Decode(&env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B)      { benchmarkEncode(b, JSON, 256) }
+func BenchmarkEncodeBinary(b *testing.B)    { benchmarkEncode(b, Binary, 256) }
+func BenchmarkEncodeJSON64K(b *testing.B)   { benchmarkEncode(b, JSON, 64<<10) }
+func BenchmarkEncodeBinary64K(b *testing.B) { benchmarkEncode(b, Binary, 64<<10) }
+func BenchmarkDecodeJSON(b *testing.B)      { benchmarkDecode(b, JSON, 256) }
+func BenchmarkDecodeBinary(b *testing.B)    { benchmarkDecode(b, Binary, 256) }
+func BenchmarkDecodeJSON64K(b *testing.B)   { benchmarkDecode(b, JSON, 64<<10) }
+func BenchmarkDecodeBinary64K(b *testing.B) { benchmarkDecode(b, Binary, 64<<10) }
+
+// The fan-out benchmarks compare a broadcast to 32 peers encoding once per
+// peer against encoding once and sharing the frame.
+const fanout = 32
+
+func benchmarkFanoutPerPeer(b *testing.B, c Codec) {
+	env := sealedEnvelope(4 << 10)
+	encs := make([]Encoder, fanout)
+	for i := range encs {
+		encs[i] = c.NewEncoder(io.Discard)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, enc := range encs {
+			enc.Encode(env)
+		}
+	}
+}
+
+func benchmarkFanoutShared(b *testing.B, c Codec) {
+	env := sealedEnvelope(4 << 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frame, _ := c.Marshal(env)
+		for j := 0; j < fanout; j++ {
+			io.Discard.Write(frame)
+		}
+	}
+}
+
+func BenchmarkFanoutPerPeerJSON(b *testing.B)   { benchmarkFanoutPerPeer(b, JSON) }
+func BenchmarkFanoutSharedJSON(b *testing.B)    { benchmarkFanoutShared(b, JSON) }
+func BenchmarkFanoutPerPeerBinary(b *testing.B) { benchmarkFanoutPerPeer(b, Binary) }
+func BenchmarkFanoutSharedBinary(b *testing.B)  { benchmarkFanoutShared(b, Binary) }
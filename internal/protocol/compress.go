@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// CompressDeflate names DEFLATE in the hello's list of accepted
+// compressions.
+const CompressDeflate = "deflate"
+
+// DefaultCompressMin is the payload size below which compression is not
+// worth a frame's worth of CPU.
+const DefaultCompressMin = 1024
+
+// Deflate compresses env's payload, leaving it as base64 of the DEFLATE
+// stream with Zip set. ok is false, and env returned unchanged, if the
+// payload is shorter than min, already compressed, sealed, or would not
+// shrink.
+//
+// Sealed payloads are never compressed: ciphertext does not shrink, and
+// compressing before sealing would let the ciphertext's length reveal how
+// much the plaintext repeats itself, which is the leak CRIME exploits.
+func Deflate(env Envelope, min int) (Envelope, bool) {
+	if env.Enc || env.Zip || len(env.Payload) < min {
+		return env, false
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	io.WriteString(w, env.Payload)
+	w.Close()
+	if base64.StdEncoding.EncodedLen(buf.Len()) >= len(env.Payload) {
+		return env, false
+	}
+	env.Payload = base64.StdEncoding.EncodeToString(buf.Bytes())
+	env.Zip = true
+	return env, true
+}
+
+// Inflate undoes Deflate. A payload that inflates past MaxFrameSize is
+// refused rather than expanded without limit.
+func Inflate(env Envelope) (Envelope, error) {
+	if !env.Zip {
+		return env, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return env, fmt.Errorf("compressed payload: %w", err)
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	plain, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return env, fmt.Errorf("compressed payload: %w", err)
+	}
+	if len(plain) > MaxFrameSize {
+		return env, fmt.Errorf("compressed payload inflates past %d bytes", MaxFrameSize)
+	}
+	env.Payload = string(plain)
+	env.Zip = false
+	return env, nil
+}
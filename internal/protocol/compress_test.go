@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDeflateRoundTrip(t *testing.T) {
+	paste := strings.Repeat("2024-05-01 12:00:00 INFO request served in 3ms\n", 100)
+	env := NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, paste)
+
+	zipped, ok := Deflate(env, DefaultCompressMin)
+	if !ok || !zipped.Zip {
+		t.Fatal("Expected a repetitive paste to be compressed")
+	}
+	if len(zipped.Payload) >= len(paste)/4 {
+		t.Errorf("Expected a much smaller payload, got %d of %d bytes", len(zipped.Payload), len(paste))
+	}
+
+	// The binary codec carries the compressed bytes raw.
+	for _, c := range []Codec{JSON, Binary} {
+		var buf bytes.Buffer
+		c.NewEncoder(&buf).Encode(zipped)
+		var got Envelope
+		if err := c.NewDecoder(&buf).Decode(&got); err != nil || got != zipped {
+			t.Fatalf("%s: got %+v (%v)", c.Name(), got, err)
+		}
+	}
+
+	plain, err := Inflate(zipped)
+	if err != nil || plain != env {
+		t.Fatalf("Inflate: got %+v (%v)", plain, err)
+	}
+}
+
+func TestDeflateSkips(t *testing.T) {
+	short := NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, "hi")
+	sealed := NewEnvelope("id2", "peer1", "nick1", "secret", TypeChat, strings.Repeat("QUFB", 1024))
+	sealed.Enc = true
+	for _, env := range []Envelope{short, sealed} {
+		if got, ok := Deflate(env, DefaultCompressMin); ok || got != env {
+			t.Errorf("Expected %s to be left alone, got %+v", env.ID, got)
+		}
+	}
+}
+
+func TestInflateRefusesBombs(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(make([]byte, MaxFrameSize+1))
+	w.Close()
+	env := NewEnvelope("id1", "peer1", "nick1", "global", TypeChat, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	env.Zip = true
+	if _, err := Inflate(env); err == nil {
+		t.Error("Expected an oversized payload to be refused")
+	}
+}
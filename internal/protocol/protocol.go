@@ -12,8 +12,97 @@ const (
 	TypePresence MessageType = "presence"
 	TypeControl  MessageType = "control"
 	TypeAck      MessageType = "ack"
+	// TypeFile carries a FileFrame to one directly connected peer.
+	TypeFile MessageType = "file"
 )
 
+const (
+	ControlPing = "ping"
+	ControlPong = "pong"
+
+	// Room subscription changes; Rooms lists the rooms affected.
+	ControlSubscribe   = "subscribe"
+	ControlUnsubscribe = "unsubscribe"
+
+	// The sender is shutting down; Sig carries the token committed to in
+	// its hello.
+	ControlLeave = "leave"
+
+	// Backlog sync: a late joiner asks its neighbours for the recent
+	// messages of Rooms[0]; members answer with them in Envelopes.
+	ControlSync      = "sync"
+	ControlSyncReply = "sync-reply"
+
+	// Gossip overlay operations.
+	ControlIHave        = "ihave"
+	ControlGraft        = "graft"
+	ControlPrune        = "prune"
+	ControlNeighbor     = "neighbor"
+	ControlDisconnect   = "disconnect"
+	ControlShuffle      = "shuffle"
+	ControlShuffleReply = "shuffle-reply"
+)
+
+type Control struct {
+	Op    string              `json:"op"`
+	Sent  int64               `json:"sent,omitempty"`
+	IDs   []string            `json:"ids,omitempty"`
+	High  bool                `json:"high,omitempty"`
+	Peers map[string][]string `json:"peers,omitempty"`
+	Rooms []string            `json:"rooms,omitempty"`
+	// Envelopes carries a sync reply's messages, sealed as on the wire,
+	// and Clock the replier's Lamport clock.
+	Envelopes []Envelope `json:"envelopes,omitempty"`
+	Clock     uint64     `json:"clock,omitempty"`
+}
+
+// AllRooms subscribes to every room. Relays and gossip forwarders use it.
+const AllRooms = "*"
+
+// Hello is the payload of the handshake presence envelope.
+type Hello struct {
+	Rooms []string `json:"rooms,omitempty"`
+	// Codecs is the dialer's offer in order of preference; Codec is the
+	// listener's choice. Both sides switch to it right after the hellos.
+	Codecs []string `json:"codecs,omitempty"`
+	Codec  string   `json:"codec,omitempty"`
+	// Compress lists the payload compressions the sender can inflate.
+	// Each side only compresses for a peer that listed the algorithm.
+	Compress []string `json:"compress,omitempty"`
+	// Leave is the hex SHA-256 of the token the sender will reveal in the
+	// sig of its leave, so receivers can tell a genuine departure.
+	Leave string `json:"leave,omitempty"`
+	// Clock is the sender's Lamport clock.
+	Clock uint64 `json:"clock,omitempty"`
+}
+
+// File transfer operations, in the order a transfer uses them.
+const (
+	FileOffer  = "offer"
+	FileAccept = "accept"
+	FileReject = "reject"
+	FileChunk  = "chunk"
+	FileDone   = "done"
+)
+
+// FileFrame is the payload of a file envelope. An offer describes the
+// file; accept asks for it from Offset, which is how interrupted transfers
+// resume; chunks carry Data starting at Offset.
+type FileFrame struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// Ack lists the IDs of chat envelopes received since the previous ack.
+type Ack struct {
+	IDs []string `json:"ids"`
+}
+
 type Envelope struct {
 	V       int         `json:"v"`
 	ID      string      `json:"id"`
@@ -24,6 +113,23 @@ type Envelope struct {
 	Type    MessageType `json:"type"`
 	Payload string      `json:"payload"`
 	Sig     string      `json:"sig,omitempty"`
+	// Enc marks a payload sealed with the room key. Relays forward such
+	// envelopes without being able to read them.
+	Enc bool `json:"enc,omitempty"`
+	// Zip marks a payload compressed with DEFLATE and base64-encoded. The
+	// transport inflates it on receipt, so applications never see it set.
+	Zip bool `json:"zip,omitempty"`
+	// Clock is the sender's Lamport clock when it sent a chat message.
+	// Rooms order messages by it rather than by arrival or TS, so replies
+	// never come before what they answer.
+	Clock uint64 `json:"clock,omitempty"`
+	// Bot marks a message a bot posted. Bots ignore such messages, so two
+	// of them in a room cannot keep answering each other.
+	Bot bool `json:"bot,omitempty"`
+
+	// Via is the directly connected peer an envelope arrived from. It is set
+	// by the transport on receipt and never sent on the wire.
+	Via string `json:"-"`
 }
 
 func NewEnvelope(id, from, nick, room string, msgType MessageType, payload string) Envelope {
@@ -48,3 +154,52 @@ func FromJSON(data []byte) (Envelope, error) {
 	err := json.Unmarshal(data, &e)
 	return e, err
 }
+
+func NewControl(id, from, nick string, c Control) Envelope {
+	data, _ := json.Marshal(c)
+	return NewEnvelope(id, from, nick, "", TypeControl, string(data))
+}
+
+func ParseControl(env Envelope) (Control, error) {
+	var c Control
+	err := json.Unmarshal([]byte(env.Payload), &c)
+	return c, err
+}
+
+func NewAck(id, from, nick string, ids []string) Envelope {
+	data, _ := json.Marshal(Ack{IDs: ids})
+	return NewEnvelope(id, from, nick, "", TypeAck, string(data))
+}
+
+func ParseAck(env Envelope) (Ack, error) {
+	var a Ack
+	err := json.Unmarshal([]byte(env.Payload), &a)
+	return a, err
+}
+
+func NewFile(id, from, nick, room string, f FileFrame) Envelope {
+	data, _ := json.Marshal(f)
+	return NewEnvelope(id, from, nick, room, TypeFile, string(data))
+}
+
+func ParseFile(env Envelope) (FileFrame, error) {
+	var f FileFrame
+	err := json.Unmarshal([]byte(env.Payload), &f)
+	return f, err
+}
+
+// NewHello builds the handshake envelope. It carries no ID so receivers can
+// tell it apart from presence announcements meant for the application.
+func NewHello(from, nick string, h Hello) Envelope {
+	data, _ := json.Marshal(h)
+	return NewEnvelope("", from, nick, "global", TypePresence, string(data))
+}
+
+// ParseHello reads a handshake payload; ok is false for peers that sent an
+// empty hello.
+func ParseHello(env Envelope) (h Hello, ok bool) {
+	if env.Payload == "" {
+		return h, false
+	}
+	return h, json.Unmarshal([]byte(env.Payload), &h) == nil
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"log"
+	"sync"
+)
+
+// cacheSize bounds how many envelope IDs the relay remembers for loop
+// suppression.
+const cacheSize = 4096
+
+// Relay forwards room traffic between peers that cannot reach each other
+// directly, such as nodes on two VLANs that both register with one
+// reachable relay. It subscribes to every room and passes envelopes on
+// unchanged: payloads of encrypted rooms stay sealed, since the relay never
+// holds a room key.
+type Relay struct {
+	tr transport.Transport
+
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+
+	done chan struct{}
+}
+
+func New(tr transport.Transport) *Relay {
+	return &Relay{
+		tr:   tr,
+		seen: make(map[string]bool),
+		done: make(chan struct{}),
+	}
+}
+
+// Start subscribes to every room and begins forwarding. The transport must
+// already be started.
+func (r *Relay) Start() {
+	r.tr.Subscribe(protocol.AllRooms)
+	go r.loop()
+}
+
+func (r *Relay) Stop() {
+	close(r.done)
+}
+
+func (r *Relay) loop() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case ev := <-r.tr.Events():
+			switch ev.Type {
+			case transport.PeerUp:
+				log.Printf("Peer up: %s (%s) at %s", ev.Nick, ev.ID, ev.Addr)
+			case transport.PeerDown:
+				if ev.Left {
+					log.Printf("Peer left: %s (%s)", ev.Nick, ev.ID)
+				} else {
+					log.Printf("Peer down: %s (%s)", ev.Nick, ev.ID)
+				}
+			}
+		case env := <-r.tr.Incoming():
+			if r.forwardable(env) {
+				r.tr.Broadcast(env)
+			}
+		}
+	}
+}
+
+// forwardable reports whether env is room traffic we have not passed on
+// yet. Remembering IDs keeps relays linked to each other from looping.
+func (r *Relay) forwardable(env protocol.Envelope) bool {
+	if env.ID == "" || (env.Type != protocol.TypeChat && env.Type != protocol.TypePresence) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[env.ID] {
+		return false
+	}
+	r.seen[env.ID] = true
+	r.order = append(r.order, env.ID)
+	if len(r.order) > cacheSize {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+	return true
+}
@@ -1,8 +1,15 @@
 package room
 
 import (
+	"encoding/json"
+	"ephemeral/internal/crypto"
 	"ephemeral/internal/protocol"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type Room struct {
@@ -11,53 +18,120 @@ type Room struct {
 	Key       []byte
 	Messages  []protocol.Envelope
 	Peers     map[string]bool
+	ids       map[string]bool
 	mu        sync.RWMutex
 }
 
 type Manager struct {
 	Rooms       map[string]*Room
 	CurrentRoom string
-	Nick        string
 	PeerID      string
+	// nick is guarded by mu: the UI changes it while the node and the
+	// control API stamp messages with it.
+	nick string
 	mu          sync.RWMutex
+
+	// clock is our Lamport clock: above every clock we have sent or seen.
+	clock atomic.Uint64
 }
 
 func NewManager(nick, peerID string) *Manager {
 	m := &Manager{
 		Rooms:       make(map[string]*Room),
 		CurrentRoom: "global",
-		Nick:        nick,
 		PeerID:      peerID,
+		nick:        nick,
 	}
 	m.Rooms["global"] = &Room{
 		Name:     "global",
 		Messages: make([]protocol.Envelope, 0),
 		Peers:    make(map[string]bool),
+		ids:      make(map[string]bool),
 	}
 	return m
 }
 
-func (m *Manager) AddMessage(env protocol.Envelope) {
+// Nick returns the nickname our messages are sent under.
+func (m *Manager) Nick() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.nick
+}
+
+// SetNick changes the nickname for messages sent from now on.
+func (m *Manager) SetNick(nick string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	
+	m.nick = nick
+}
+
+// MaxClock bounds the Lamport clocks we accept from peers. Clocks count
+// messages and never come near it; a larger one comes from a broken or
+// hostile peer and would push every clock towards wrapping around.
+const MaxClock = 1 << 48
+
+// Tick advances the clock for a message we are about to send and returns
+// the value to stamp it with.
+func (m *Manager) Tick() uint64 {
+	return m.clock.Add(1)
+}
+
+// Clock returns the current value of the clock.
+func (m *Manager) Clock() uint64 {
+	return m.clock.Load()
+}
+
+// Observe moves the clock past c, a clock a peer reported. Clocks above
+// MaxClock are ignored.
+func (m *Manager) Observe(c uint64) {
+	if c > MaxClock {
+		return
+	}
+	for {
+		cur := m.clock.Load()
+		if c <= cur || m.clock.CompareAndSwap(cur, c) {
+			return
+		}
+	}
+}
+
+// AddMessage stores env in its room and reports whether it was new.
+// Envelopes for rooms we have not joined, and retransmitted envelopes with
+// an ID the room already holds, are dropped.
+//
+// Messages are kept in causal order: by Lamport clock, then sender, then
+// ID, so every participant sees the same sequence. An envelope without a
+// clock (older peers, local notices) or with one above MaxClock is placed
+// as if sent now.
+func (m *Manager) AddMessage(env protocol.Envelope) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	r, exists := m.Rooms[env.Room]
 	if !exists {
-		r = &Room{
-			Name:     env.Room,
-			Messages: make([]protocol.Envelope, 0),
-			Peers:    make(map[string]bool),
-		}
-		m.Rooms[env.Room] = r
+		return false
 	}
-	
+
 	r.mu.Lock()
-	r.Messages = append(r.Messages, env)
+	defer r.mu.Unlock()
+	if r.ids[env.ID] {
+		return false
+	}
+	if env.Clock == 0 || env.Clock > MaxClock {
+		env.Clock = m.clock.Load()
+	}
+	m.Observe(env.Clock)
+	r.ids[env.ID] = true
+	i := sort.Search(len(r.Messages), func(i int) bool { return before(env, r.Messages[i]) })
+	r.Messages = slices.Insert(r.Messages, i, env)
 	if len(r.Messages) > 1000 {
+		for _, old := range r.Messages[:len(r.Messages)-1000] {
+			delete(r.ids, old.ID)
+		}
 		r.Messages = r.Messages[len(r.Messages)-1000:]
 	}
 	r.Peers[env.From] = true
-	r.mu.Unlock()
+	return true
 }
 
 func (m *Manager) GetMessages(roomName string) []protocol.Envelope {
@@ -76,6 +150,19 @@ func (m *Manager) GetMessages(roomName string) []protocol.Envelope {
 	return msgs
 }
 
+// ClearMessages forgets the messages of roomName. Its IDs are forgotten
+// too, so a message resent after a reconnect shows up again.
+func (m *Manager) ClearMessages(roomName string) {
+	r := m.room(roomName)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Messages = nil
+	r.ids = make(map[string]bool)
+}
+
 func (m *Manager) Join(roomName string, encrypted bool, key []byte) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -87,9 +174,146 @@ func (m *Manager) Join(roomName string, encrypted bool, key []byte) {
 			Key:       key,
 			Messages:  make([]protocol.Envelope, 0),
 			Peers:     make(map[string]bool),
+			ids:       make(map[string]bool),
 		}
 	}
+}
+
+// Switch makes roomName, which must already be joined, the current room.
+// Only the UI switches rooms; joining from a script or a bot leaves the
+// room the user is typing into alone.
+func (m *Manager) Switch(roomName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.Rooms[roomName]; !exists {
+		return false
+	}
 	m.CurrentRoom = roomName
+	return true
+}
+
+// Leave forgets roomName and its messages. The global room cannot be left;
+// leaving the current room switches back to global.
+func (m *Manager) Leave(roomName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if roomName == "global" {
+		return false
+	}
+	if _, exists := m.Rooms[roomName]; !exists {
+		return false
+	}
+	delete(m.Rooms, roomName)
+	if m.CurrentRoom == roomName {
+		m.CurrentRoom = "global"
+	}
+	return true
+}
+
+// before reports whether a sorts ahead of b.
+func before(a, b protocol.Envelope) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	if a.From != b.From {
+		return a.From < b.From
+	}
+	return a.ID < b.ID
+}
+
+// RoomKey derives the key for an encrypted room from its password with
+// Argon2id. The room name is part of the salt, so one password does not
+// unlock every room and guesses cannot be precomputed for all of them.
+func RoomKey(roomName, password string) ([]byte, error) {
+	return crypto.DeriveKey(password, "ephemeral/room/"+roomName)
+}
+
+// sealedFields is the additional data a sealed payload is bound to: the
+// envelope fields around it that say where it belongs and who sent it.
+// Anyone on the path can read them, but changing one, or replaying the
+// payload under a new ID, makes Open fail.
+func sealedFields(env protocol.Envelope) []byte {
+	data, _ := json.Marshal([]any{env.Room, env.From, env.Nick, env.ID, env.Clock, env.Type, env.Bot})
+	return data
+}
+
+// Seal encrypts env's payload if its room is encrypted, leaving everything
+// but the payload readable for routing.
+func (m *Manager) Seal(env protocol.Envelope) (protocol.Envelope, error) {
+	r := m.room(env.Room)
+	if r == nil || !r.Encrypted {
+		return env, nil
+	}
+	sealed, err := crypto.Encrypt(r.Key, env.Payload, sealedFields(env))
+	if err != nil {
+		return env, err
+	}
+	env.Payload = sealed
+	env.Enc = true
+	return env, nil
+}
+
+// Open decrypts a sealed envelope. It fails if we do not hold the room's key
+// (or hold a different one), and rejects plaintext sent to a room we joined
+// with a password.
+func (m *Manager) Open(env protocol.Envelope) (protocol.Envelope, error) {
+	r := m.room(env.Room)
+	switch {
+	case r == nil:
+		return env, fmt.Errorf("not in room %s", env.Room)
+	case !env.Enc && r.Encrypted:
+		return env, fmt.Errorf("unencrypted message in encrypted room %s", env.Room)
+	case !env.Enc:
+		return env, nil
+	case !r.Encrypted:
+		return env, errors.New("no key for encrypted message")
+	}
+	plain, err := crypto.Decrypt(r.Key, env.Payload, sealedFields(env))
+	if err != nil {
+		return env, err
+	}
+	env.Payload = plain
+	env.Enc = false
+	return env, nil
+}
+
+func (m *Manager) room(roomName string) *Room {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Rooms[roomName]
+}
+
+func (m *Manager) Joined(roomName string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, exists := m.Rooms[roomName]
+	return exists
+}
+
+// Encrypted reports whether roomName was joined with a password.
+func (m *Manager) Encrypted(roomName string) bool {
+	r := m.room(roomName)
+	return r != nil && r.Encrypted
+}
+
+// Names lists the joined rooms in alphabetical order.
+func (m *Manager) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.Rooms))
+	for name := range m.Rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CurrentName returns the name of the current room.
+func (m *Manager) CurrentName() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.CurrentRoom
 }
 
 func (m *Manager) Current() *Room {
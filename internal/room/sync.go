@@ -0,0 +1,69 @@
+package room
+
+import (
+	"ephemeral/internal/protocol"
+	"time"
+)
+
+// Backlog bounds: a sync reply carries at most BacklogLimit messages, none
+// older than BacklogAge. History only ever lives in memory.
+const (
+	BacklogLimit = 100
+	BacklogAge   = time.Hour
+)
+
+// Backlog returns the recent messages of roomName for a peer that just
+// joined it, oldest first and sealed again if the room is encrypted, so
+// only holders of the key can read them. Local notices are left out. ok is
+// false if we are not in the room.
+func (m *Manager) Backlog(roomName string) (envs []protocol.Envelope, ok bool) {
+	r := m.room(roomName)
+	if r == nil {
+		return nil, false
+	}
+	cutoff := time.Now().Add(-BacklogAge).Unix()
+
+	r.mu.RLock()
+	for i := len(r.Messages) - 1; i >= 0 && len(envs) < BacklogLimit; i-- {
+		env := r.Messages[i]
+		if env.From == "system" || env.TS < cutoff {
+			continue
+		}
+		envs = append(envs, env)
+	}
+	r.mu.RUnlock()
+
+	sealed := make([]protocol.Envelope, 0, len(envs))
+	for i := len(envs) - 1; i >= 0; i-- {
+		env, err := m.Seal(envs[i])
+		if err != nil {
+			continue
+		}
+		sealed = append(sealed, env)
+	}
+	return sealed, true
+}
+
+// MergeBacklog adds a sync reply's messages for roomName and returns the
+// ones that were new, opened. Messages for other rooms, beyond the bounds, or that we
+// cannot open are dropped; duplicates are recognised by ID.
+func (m *Manager) MergeBacklog(roomName string, envs []protocol.Envelope) []protocol.Envelope {
+	if len(envs) > BacklogLimit {
+		envs = envs[len(envs)-BacklogLimit:]
+	}
+	cutoff := time.Now().Add(-BacklogAge).Unix()
+	var added []protocol.Envelope
+	for _, env := range envs {
+		if env.Room != roomName || env.Type != protocol.TypeChat || env.TS < cutoff {
+			continue
+		}
+		opened, err := m.Open(env)
+		if err != nil {
+			continue
+		}
+		if m.AddMessage(opened) {
+			added = append(added, opened)
+		}
+	}
+	return added
+}
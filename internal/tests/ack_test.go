@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"encoding/json"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawPeer speaks the wire protocol by hand so tests can withhold acks.
+type rawPeer struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func dialRaw(t *testing.T, port int, id string) *rawPeer {
+	t.Helper()
+	return dialRawHello(t, port, protocol.NewEnvelope("", id, id, "global", protocol.TypePresence, ""))
+}
+
+func dialRawHello(t *testing.T, port int, hello protocol.Envelope) *rawPeer {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	p := &rawPeer{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	if err := p.enc.Encode(hello); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	return p
+}
+
+func (p *rawPeer) nextChat(t *testing.T) protocol.Envelope {
+	t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var env protocol.Envelope
+		if err := p.dec.Decode(&env); err != nil {
+			t.Fatalf("Waiting for chat: %v", err)
+		}
+		if env.Type == protocol.TypeChat {
+			return env
+		}
+	}
+}
+
+func TestAckAndRetransmit(t *testing.T) {
+	tr := transport.NewTCP(0, "peerA", "Alice")
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	bob := dialRaw(t, transport.Port(tr), "peerB")
+	waitFor(t, time.Second, "Bob to connect", func() bool { return len(tr.Peers()) == 1 })
+
+	env := protocol.NewEnvelope("msg1", "peerA", "Alice", "global", protocol.TypeChat, "are you there?")
+	tr.Broadcast(env)
+	if got := bob.nextChat(t); got.ID != "msg1" {
+		t.Fatalf("Expected msg1, got %s", got.ID)
+	}
+	if st, ok := tr.Delivery("msg1"); !ok || st.Pending != 1 || st.Acked != 0 {
+		t.Fatalf("Expected 1 pending delivery, got %+v (ok=%v)", st, ok)
+	}
+
+	// Bob drops without acking and comes back on a fresh connection.
+	bob.conn.Close()
+	waitFor(t, time.Second, "Bob to disconnect", func() bool { return len(tr.Peers()) == 0 })
+	bob = dialRaw(t, transport.Port(tr), "peerB")
+	defer bob.conn.Close()
+
+	if got := bob.nextChat(t); got.ID != "msg1" {
+		t.Fatalf("Expected retransmitted msg1, got %s", got.ID)
+	}
+	if err := bob.enc.Encode(protocol.NewAck("ack1", "peerB", "Bob", []string{"msg1"})); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	select {
+	case ev := <-tr.Acks():
+		if ev.ID != "msg1" || ev.Peer != "peerB" {
+			t.Errorf("Unexpected ack event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for ack event")
+	}
+	if st, _ := tr.Delivery("msg1"); st.Pending != 0 || st.Acked != 1 {
+		t.Errorf("Expected msg1 delivered, got %+v", st)
+	}
+}
+
+func TestReceiverAcksChat(t *testing.T) {
+	tr := transport.NewTCP(0, "peerA", "Alice")
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	bob := dialRaw(t, transport.Port(tr), "peerB")
+	defer bob.conn.Close()
+	for _, id := range []string{"b1", "b2"} {
+		bob.enc.Encode(protocol.NewEnvelope(id, "peerB", "Bob", "global", protocol.TypeChat, "hi"))
+	}
+
+	bob.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	acked := map[string]bool{}
+	for len(acked) < 2 {
+		var env protocol.Envelope
+		if err := bob.dec.Decode(&env); err != nil {
+			t.Fatalf("Waiting for ack: %v", err)
+		}
+		if env.Type != protocol.TypeAck {
+			continue
+		}
+		a, err := protocol.ParseAck(env)
+		if err != nil {
+			t.Fatalf("ParseAck failed: %v", err)
+		}
+		for _, id := range a.IDs {
+			acked[id] = true
+		}
+	}
+}
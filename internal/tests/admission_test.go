@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"ephemeral/internal/transport"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSilentConnectionIsDroppedAfterHandshakeTimeout(t *testing.T) {
+	tr := transport.NewTCP(0, "peerA", "Alice")
+	tr.HandshakeTimeout = 100 * time.Millisecond
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	conn, err := net.Dial("tcp", tcpAddr(tr))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the listener to hang up, got %v", err)
+	}
+	waitFor(t, time.Second, "slot released", func() bool {
+		st := tr.Admission()
+		return st.HandshakeTimeouts == 1 && st.Inbound == 0
+	})
+}
+
+func TestConnectionLimits(t *testing.T) {
+	trA := transport.NewTCP(0, "peerA", "Alice")
+	trA.MaxInbound = 2
+	trA.MaxOutbound = 1
+	if err := trA.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer trA.Stop()
+
+	for _, id := range []string{"raw1", "raw2"} {
+		p := dialRaw(t, transport.Port(trA), id)
+		defer p.conn.Close()
+		expectEvent(t, trA, transport.PeerUp, id)
+	}
+	extra := dialRaw(t, transport.Port(trA), "raw3")
+	defer extra.conn.Close()
+	extra.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := extra.conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the third inbound connection to be refused")
+	}
+	if st := trA.Admission(); st.RejectedInbound != 1 || st.Inbound != 2 {
+		t.Errorf("Unexpected admission stats: %+v", st)
+	}
+
+	trB := transport.NewTCP(0, "peerB", "Bob")
+	trC := transport.NewTCP(0, "peerC", "Carol")
+	for _, tr := range []*transport.Mesh{trB, trC} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	if err := trA.Dial("peerB", tcpAddr(trB)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err := trA.Dial("peerC", tcpAddr(trC)); !errors.Is(err, transport.ErrOutboundLimit) {
+		t.Errorf("Expected the outbound limit, got %v", err)
+	}
+}
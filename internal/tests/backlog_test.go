@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBacklogSyncRespectsBoundsAndKeys(t *testing.T) {
+	key, _ := room.RoomKey("secret", "hunter2")
+	alice := room.NewManager("Alice", "peerA")
+	alice.Join("secret", true, key)
+
+	stale := protocol.NewEnvelope("old", "peerC", "Carol", "secret", protocol.TypeChat, "from yesterday")
+	stale.TS = time.Now().Add(-2 * room.BacklogAge).Unix()
+	alice.AddMessage(stale)
+	for i := 0; i < room.BacklogLimit+10; i++ {
+		env := protocol.NewEnvelope(fmt.Sprintf("m%03d", i), "peerC", "Carol", "secret", protocol.TypeChat, fmt.Sprintf("line %d", i))
+		env.Clock = uint64(i + 1)
+		alice.AddMessage(env)
+	}
+
+	backlog, ok := alice.Backlog("secret")
+	if !ok || len(backlog) != room.BacklogLimit {
+		t.Fatalf("Expected %d messages, got %d", room.BacklogLimit, len(backlog))
+	}
+	for _, env := range backlog {
+		if !env.Enc {
+			t.Fatalf("Expected the backlog of an encrypted room to be sealed, got %+v", env)
+		}
+	}
+	if _, ok := alice.Backlog("elsewhere"); ok {
+		t.Error("Expected no backlog for a room we are not in")
+	}
+
+	// The reply crosses a real link intact.
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	trA.Codecs = []string{protocol.CodecBinary}
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	if err := trA.Dial("peerB", "b"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	trA.Send("peerB", protocol.NewControl("r1", "peerA", "Alice", protocol.Control{Op: protocol.ControlSyncReply, Rooms: []string{"secret"}, Envelopes: backlog}))
+	var reply protocol.Control
+	select {
+	case env := <-trB.Incoming():
+		reply, _ = protocol.ParseControl(env)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for the sync reply")
+	}
+
+	bob := room.NewManager("Bob", "peerB")
+	bob.Join("secret", true, key)
+	if n := len(bob.MergeBacklog("secret", reply.Envelopes)); n != room.BacklogLimit {
+		t.Errorf("Expected %d messages merged, got %d", room.BacklogLimit, n)
+	}
+	if n := len(bob.MergeBacklog("secret", reply.Envelopes)); n != 0 {
+		t.Errorf("Expected duplicates to be dropped, got %d new", n)
+	}
+	msgs := bob.GetMessages("secret")
+	if msgs[0].ID != "m010" || msgs[len(msgs)-1].Payload != "line 109" {
+		t.Errorf("Unexpected backlog range %s..%s", msgs[0].ID, msgs[len(msgs)-1].ID)
+	}
+
+	wrongKey, _ := room.RoomKey("secret", "guess")
+	eve := room.NewManager("Eve", "peerE")
+	eve.Join("secret", true, wrongKey)
+	if n := len(eve.MergeBacklog("secret", reply.Envelopes)); n != 0 {
+		t.Errorf("Expected nothing readable without the key, got %d", n)
+	}
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"context"
+	"ephemeral/internal/bot"
+	"ephemeral/internal/config"
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+// botNode links a node running bots to a plain mesh that plays the user.
+func botNode(t *testing.T) (*node.Node, *transport.Mesh, *bot.Runner) {
+	t.Helper()
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Bot")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+	}
+	n := node.New(room.NewManager("Bot", "peerA"), trA, nil, nil)
+	n.Start()
+	t.Cleanup(n.Stop)
+	r := bot.New(n)
+	t.Cleanup(r.Stop)
+	return n, trB, r
+}
+
+func linkUser(t *testing.T, user *transport.Mesh, rooms ...string) {
+	t.Helper()
+	for _, r := range rooms {
+		user.Subscribe(r)
+	}
+	if err := user.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	waitFor(t, 2*time.Second, "the bot's subscription", func() bool {
+		p := user.Peers()
+		return len(p) == 1 && contains(p[0].Rooms, rooms[0])
+	})
+}
+
+func TestBotHandlerReplies(t *testing.T) {
+	bot.Register("echo", bot.HandlerFunc(func(ctx context.Context, env protocol.Envelope) ([]string, error) {
+		return []string{"status of " + strings.TrimPrefix(env.Payload, "!status ") + ": green"}, nil
+	}))
+	_, user, r := botNode(t)
+	h, err := bot.FromConfig(config.BotConfig{Name: "status", Rooms: []string{"ops"}, Match: `^!status\b`, Handler: "echo"})
+	if err != nil {
+		t.Fatalf("FromConfig failed: %v", err)
+	}
+	if err := r.Add(h); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	r.Start()
+	linkUser(t, user, "ops")
+
+	user.Broadcast(protocol.NewEnvelope("u1", "peerB", "Bob", "ops", protocol.TypeChat, "unrelated chatter"))
+	user.Broadcast(protocol.NewEnvelope("u2", "peerB", "Bob", "ops", protocol.TypeChat, "!status deploy"))
+	expectChat(t, user, "status of deploy: green")
+
+	if _, err := bot.FromConfig(config.BotConfig{Name: "x", Handler: "missing"}); err == nil {
+		t.Error("Expected an unregistered handler to be refused")
+	}
+	if _, err := bot.FromConfig(config.BotConfig{Name: "x", Command: []string{"true"}, Handler: "echo"}); err == nil {
+		t.Error("Expected a bot with both a command and a handler to be refused")
+	}
+}
+
+func TestBotExecIsSandboxedAndTimedOut(t *testing.T) {
+	t.Setenv("EPHEMERAL_TEST_SECRET", "s3cret")
+	_, user, r := botNode(t)
+	for _, c := range []config.BotConfig{
+		{
+			Name:    "env",
+			Rooms:   []string{"ops"},
+			Match:   "^!env$",
+			Command: []string{"sh", "-c", `echo "secret=[$EPHEMERAL_TEST_SECRET] extra=[$GREETING] from=$EPHEMERAL_NICK"; cat >/dev/null`},
+			Env:     []string{"GREETING=hi"},
+		},
+		{
+			Name:    "slow",
+			Rooms:   []string{"ops"},
+			Match:   "^!slow$",
+			Command: []string{"sh", "-c", "sleep 5; echo too late"},
+			Timeout: 100 * time.Millisecond,
+		},
+	} {
+		h, err := bot.FromConfig(c)
+		if err != nil {
+			t.Fatalf("FromConfig failed: %v", err)
+		}
+		r.Add(h)
+	}
+	r.Start()
+	linkUser(t, user, "ops")
+
+	user.Broadcast(protocol.NewEnvelope("u1", "peerB", "Bob", "ops", protocol.TypeChat, "!slow"))
+	user.Broadcast(protocol.NewEnvelope("u2", "peerB", "Bob", "ops", protocol.TypeChat, "!env"))
+	expectChat(t, user, "secret=[] extra=[hi] from=Bob")
+
+	// The slow command was killed: nothing more arrives.
+	select {
+	case env := <-user.Incoming():
+		if env.Type == protocol.TypeChat {
+			t.Errorf("Expected no reply from the timed out bot, got %q", env.Payload)
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestBotsDoNotAnswerEachOther(t *testing.T) {
+	bot.Register("parrot", bot.HandlerFunc(func(ctx context.Context, env protocol.Envelope) ([]string, error) {
+		return []string{"heard " + env.Payload}, nil
+	}))
+	network := transport.NewMemoryNetwork()
+	user := transport.NewMemory(network, "u", "peerU", "User")
+	if err := user.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(user.Stop)
+	user.Subscribe("ops")
+	for _, id := range []string{"peerA", "peerB"} {
+		tr := transport.NewMemory(network, id, id, "Parrot")
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+		n := node.New(room.NewManager("Parrot", id), tr, nil, nil)
+		n.Start()
+		t.Cleanup(n.Stop)
+		r := bot.New(n)
+		t.Cleanup(r.Stop)
+		h, err := bot.FromConfig(config.BotConfig{Name: "parrot", Rooms: []string{"ops"}, Handler: "parrot"})
+		if err != nil {
+			t.Fatalf("FromConfig failed: %v", err)
+		}
+		if err := r.Add(h); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		r.Start()
+		if id == "peerB" {
+			if err := tr.Dial("peerA", "peerA"); err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+		}
+		if err := user.Dial(id, id); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+	}
+	waitFor(t, 2*time.Second, "both bots' subscriptions", func() bool {
+		p := user.Peers()
+		return len(p) == 2 && contains(p[0].Rooms, "ops") && contains(p[1].Rooms, "ops")
+	})
+
+	user.Broadcast(protocol.NewEnvelope("u1", "peerU", "User", "ops", protocol.TypeChat, "hello"))
+
+	// Each bot answers the user once; neither answers the other's reply.
+	replies := map[string]int{}
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case env := <-user.Incoming():
+			if env.Type != protocol.TypeChat {
+				continue
+			}
+			if env.Payload != "heard hello" || !env.Bot {
+				t.Fatalf("Expected only marked replies to the user, got %+v", env)
+			}
+			replies[env.From]++
+		case <-deadline:
+			if replies["peerA"] != 1 || replies["peerB"] != 1 {
+				t.Errorf("Expected one reply from each bot, got %v", replies)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package tests
+
+import (
+	"encoding/json"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkBroadcast measures one 4 KiB broadcast to 32 connected peers;
+// the envelope is encoded once and the frame shared by every writer.
+func BenchmarkBroadcast(b *testing.B) {
+	tr := transport.NewTCP(0, "hub", "hub")
+	if err := tr.Start(); err != nil {
+		b.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	for i := 0; i < 32; i++ {
+		conn, err := net.Dial("tcp", tr.Addr().String())
+		if err != nil {
+			b.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		id := fmt.Sprintf("peer%d", i)
+		json.NewEncoder(conn).Encode(protocol.NewEnvelope("", id, id, "global", protocol.TypePresence, ""))
+		go io.Copy(io.Discard, conn)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(tr.Peers()) < 32; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			b.Fatalf("Only %d of 32 peers connected", len(tr.Peers()))
+		}
+	}
+
+	env := protocol.NewEnvelope("m1", "elsewhere", "x", "global", protocol.TypeChat, strings.Repeat("x", 4<<10))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Broadcast(env)
+	}
+}
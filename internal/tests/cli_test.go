@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"bytes"
+	"ephemeral/internal/control"
+	"ephemeral/internal/node"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// buildCLI builds the ephemeral command into a temporary directory.
+func buildCLI(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "ephemeral")
+	if out, err := exec.Command("go", "build", "-o", bin, "ephemeral/cmd/ephemeral").CombinedOutput(); err != nil {
+		t.Fatalf("Build failed: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// cliCommand runs bin with a config directory of its own and no
+// EPHEMERAL_* variables from the caller.
+func cliCommand(t *testing.T, bin string, args ...string) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	home := t.TempDir()
+	cmd := exec.Command(bin, args...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "EPHEMERAL_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, "XDG_CONFIG_HOME="+home, "XDG_STATE_HOME="+home)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	return cmd, &stdout, &stderr
+}
+
+// runCLI runs bin to completion and returns its exit status.
+func runCLI(t *testing.T, bin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	cmd, out, errOut := cliCommand(t, bin, args...)
+	return exitCode(t, cmd.Run()), out.String(), errOut.String()
+}
+
+func exitCode(t *testing.T, err error) int {
+	t.Helper()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return 0
+}
+
+// unixNode starts a node listening on a Unix socket at path, which the
+// one-shot commands find when given a socket in the same directory.
+func unixNode(t *testing.T, path, id, nick string) (*node.Node, *transport.Mesh) {
+	t.Helper()
+	tr := transport.NewUnix(path, id, nick)
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(tr.Stop)
+	n := node.New(room.NewManager(nick, id), tr, nil, nil)
+	n.Start()
+	t.Cleanup(n.Stop)
+	return n, tr
+}
+
+func TestSendDeliversAndExitsZero(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	n, _ := unixNode(t, filepath.Join(dir, "alice.sock"), "peerA", "Alice")
+	events, cancel := n.Subscribe()
+	defer cancel()
+
+	code, _, stderr := runCLI(t, bin, "send", "--unix", filepath.Join(dir, "send.sock"), "hello", "from", "a", "script")
+	if code != 0 {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == node.Message && ev.Message.Payload == "hello from a script" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("The message never arrived")
+		}
+	}
+}
+
+func TestSendLeavesWithoutANotice(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	n, _ := unixNode(t, filepath.Join(dir, "alice.sock"), "peerA", "Alice")
+	events, cancel := n.Subscribe()
+	defer cancel()
+
+	if code, _, stderr := runCLI(t, bin, "send", "--unix", filepath.Join(dir, "send.sock"), "done"); code != 0 {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == node.Message && strings.HasSuffix(ev.Message.Payload, " left") {
+				t.Fatalf("Expected no leave notice for a one-shot send, got %q", ev.Message.Payload)
+			}
+			if ev.Kind != node.PeerDown {
+				continue
+			}
+			if ev.Peer.Left {
+				t.Errorf("Expected the sender to drop rather than announce a leave, got %+v", ev.Peer)
+			}
+			return
+		case <-deadline:
+			t.Fatal("The sender never went away")
+		}
+	}
+}
+
+func TestSendWithoutPeersExitsTwo(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+
+	start := time.Now()
+	code, _, stderr := runCLI(t, bin, "send", "--unix", filepath.Join(dir, "send.sock"), "--wait", "300ms", "anyone?")
+	if code != 2 {
+		t.Fatalf("Expected exit 2, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stderr, "No peer in global") {
+		t.Errorf("Expected the reason on stderr, got %q", stderr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected send to give up after --wait, took %s", d)
+	}
+
+	if code, _, _ := runCLI(t, bin, "send", "--unix", filepath.Join(dir, "send.sock")); code != 1 {
+		t.Errorf("Expected exit 1 without a message, got %d", code)
+	}
+}
+
+func TestPeersListsLinkedPeers(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+
+	if code, _, stderr := runCLI(t, bin, "peers", "--unix", filepath.Join(dir, "peers.sock"), "--wait", "300ms"); code != 2 {
+		t.Fatalf("Expected exit 2 with nobody around, got %d: %s", code, stderr)
+	}
+
+	unixNode(t, filepath.Join(dir, "alice.sock"), "peerA", "Alice")
+	code, stdout, stderr := runCLI(t, bin, "peers", "--unix", filepath.Join(dir, "peers.sock"), "--wait", "300ms", "--json")
+	if code != 0 {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, `"nick":"Alice"`) || !strings.Contains(stdout, `"connected":true`) {
+		t.Errorf("Expected Alice listed as connected, got %s", stdout)
+	}
+}
+
+func TestListenPrintsMessagesUntilInterrupted(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	n, tr := unixNode(t, filepath.Join(dir, "alice.sock"), "peerA", "Alice")
+
+	cmd, stdout, stderr := cliCommand(t, bin, "listen", "--unix", filepath.Join(dir, "listen.sock"))
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer cmd.Process.Kill()
+	waitFor(t, 5*time.Second, "the listener to link", func() bool { return len(tr.Peers()) == 1 })
+
+	if _, err := n.Say("global", "anyone listening?"); err != nil {
+		t.Fatalf("Say failed: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+	if code := exitCode(t, cmd.Wait()); code != 0 {
+		t.Fatalf("Expected exit 0 on SIGTERM, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout.String(), "Alice: anyone listening?") {
+		t.Errorf("Expected the message printed, got %q", stdout.String())
+	}
+}
+
+func TestOneShotCommandsLeaveControlAndBotsToTheInstance(t *testing.T) {
+	bin := buildCLI(t)
+	dir, other := t.TempDir(), t.TempDir()
+	n, _ := unixNode(t, filepath.Join(dir, "alice.sock"), "peerA", "Alice")
+	sock := filepath.Join(other, "control.sock")
+	api := control.New(n)
+	if err := api.Listen(sock); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(api.Close)
+
+	// Alice greets every peer, which a bot in the one-shot command would
+	// answer by leaving a file behind.
+	events, cancel := n.Subscribe()
+	defer cancel()
+	go func() {
+		for ev := range events {
+			if ev.Kind == node.PeerUp {
+				n.Say("global", "welcome")
+			}
+		}
+	}()
+	ran := filepath.Join(other, "bot-ran")
+	cfgPath := filepath.Join(other, "config.yaml")
+	cfg := fmt.Sprintf("control: %s\nbots:\n  - name: witness\n    command: [touch, %s]\n", sock, ran)
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, stderr := runCLI(t, bin, "send", "--config", cfgPath, "--unix", filepath.Join(dir, "send.sock"), "hi")
+	if code != 0 {
+		t.Fatalf("Expected exit 0 beside the instance owning the control socket, got %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("Expected send not to run the configured bots")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Expected the instance's control socket to survive: %v", err)
+	}
+	conn.Close()
+}
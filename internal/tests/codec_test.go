@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"testing"
+	"time"
+)
+
+func TestBinaryCodecIsNegotiated(t *testing.T) {
+	trA := transport.NewTCP(0, "peerA", "Alice")
+	trA.Codecs = []string{protocol.CodecBinary, protocol.CodecJSON}
+	trB := transport.NewTCP(0, "peerB", "Bob")
+	trC := transport.NewTCP(0, "peerC", "Carol")
+	for _, tr := range []*transport.Mesh{trA, trB, trC} {
+		tr.Heartbeat = 50 * time.Millisecond
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	// Alice prefers binary; Carol only offers JSON.
+	if err := trA.Dial("peerB", tcpAddr(trB)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err := trC.Dial("peerB", tcpAddr(trB)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	codecs := map[string]string{}
+	for _, p := range trB.Peers() {
+		codecs[p.ID] = p.Codec
+	}
+	if codecs["peerA"] != protocol.CodecBinary || codecs["peerC"] != protocol.CodecJSON {
+		t.Errorf("Unexpected codecs on Bob's links: %v", codecs)
+	}
+	if p := trA.Peers(); len(p) != 1 || p[0].Codec != protocol.CodecBinary {
+		t.Errorf("Expected Alice to use binary, got %+v", p)
+	}
+
+	env := protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, "compact")
+	trA.Broadcast(env)
+	expectChat(t, trB, "compact")
+	trB.Broadcast(protocol.NewEnvelope("m2", "peerB", "Bob", "global", protocol.TypeChat, "both ways"))
+	expectChat(t, trA, "both ways")
+	expectChat(t, trC, "both ways")
+
+	// Heartbeats and acks keep flowing over the binary link.
+	waitFor(t, 2*time.Second, "RTT over binary", func() bool {
+		p := trA.Peers()
+		return len(p) == 1 && p[0].RTT > 0
+	})
+	waitFor(t, 2*time.Second, "ack over binary", func() bool {
+		st, ok := trA.Delivery("m1")
+		return ok && st.Acked == 1
+	})
+}
+
+func tcpAddr(tr transport.Transport) string {
+	return tr.Addr().String()
+}
@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLargePayloadsAreCompressedForPeersThatAccept(t *testing.T) {
+	trA := transport.NewTCP(0, "peerA", "Alice")
+	trB := transport.NewTCP(0, "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	if err := trB.Dial("peerA", tcpAddr(trA)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// One hand-rolled peer accepts deflate, the other predates it.
+	zipper := dialRawHello(t, transport.Port(trA), protocol.NewHello("zipper", "zipper", protocol.Hello{Rooms: []string{"global"}, Compress: []string{protocol.CompressDeflate}}))
+	defer zipper.conn.Close()
+	plain := dialRaw(t, transport.Port(trA), "plain")
+	defer plain.conn.Close()
+	waitFor(t, 2*time.Second, "all peers linked", func() bool { return len(trA.Peers()) == 3 })
+
+	compressed := map[string]bool{}
+	for _, p := range trA.Peers() {
+		compressed[p.ID] = p.Compress
+	}
+	if !compressed["peerB"] || !compressed["zipper"] || compressed["plain"] {
+		t.Errorf("Unexpected compression per link: %v", compressed)
+	}
+
+	paste := strings.Repeat("panic: runtime error: index out of range [3] with length 3\n", 50)
+	trA.Broadcast(protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, paste))
+
+	expectChat(t, trB, paste)
+	if env := zipper.nextChat(t); !env.Zip || len(env.Payload) >= len(paste)/4 {
+		t.Errorf("Expected a compressed payload, got %d bytes (zip=%v)", len(env.Payload), env.Zip)
+	}
+	if env := plain.nextChat(t); env.Zip || env.Payload != paste {
+		t.Errorf("Expected the paste as is, got zip=%v and %d bytes", env.Zip, len(env.Payload))
+	}
+
+	// Short messages go out untouched.
+	trA.Broadcast(protocol.NewEnvelope("m2", "peerA", "Alice", "global", protocol.TypeChat, "short"))
+	if env := zipper.nextChat(t); env.Zip || env.Payload != "short" {
+		t.Errorf("Expected a short message uncompressed, got %+v", env)
+	}
+}
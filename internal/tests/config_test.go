@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"ephemeral/internal/config"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileOverlaysDefaults(t *testing.T) {
+	cfg, err := config.Load(writeConfig(t, `
+nick: alice
+discovery:
+  mdns: false
+limits:
+  handshake_timeout: 2s
+rooms:
+  - name: ops
+    encrypted: true
+    password: hunter2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Nick != "alice" || cfg.Discovery.MDNS || cfg.Limits.HandshakeTimeout != 2*time.Second {
+		t.Fatalf("file settings not applied: %+v", cfg)
+	}
+	// Settings the file leaves out keep their defaults.
+	if cfg.Port != 9999 || !cfg.Discovery.UDPFallback || cfg.Limits.MaxInbound != 128 || cfg.Overlay.Mode != "auto" {
+		t.Fatalf("defaults lost: %+v", cfg)
+	}
+	if len(cfg.Rooms) != 1 || cfg.Rooms[0].Password != "hunter2" {
+		t.Fatalf("rooms = %+v", cfg.Rooms)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.Load(writeConfig(t, "nikc: typo\n")); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+	if _, err := config.Load(writeConfig(t, "")); err != nil {
+		t.Fatalf("empty file: %v", err)
+	}
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"EPHEMERAL_NICK":                     "bob",
+		"EPHEMERAL_PORT":                     "7000",
+		"EPHEMERAL_PEERS":                    "10.0.0.1:9999, 10.0.0.2:9999",
+		"EPHEMERAL_DISCOVERY_UDP_FALLBACK":   "false",
+		"EPHEMERAL_LIMITS_HANDSHAKE_TIMEOUT": "750ms",
+		"EPHEMERAL_LOGGING_LEVEL":            "warn",
+	}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	cfg := config.Default()
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Nick != "bob" || cfg.Port != 7000 || cfg.Discovery.UDPFallback || cfg.Limits.HandshakeTimeout != 750*time.Millisecond || cfg.Logging.Level != "warn" {
+		t.Fatalf("env not applied: %+v", cfg)
+	}
+	if !slices.Equal(cfg.Peers, []string{"10.0.0.1:9999", "10.0.0.2:9999"}) {
+		t.Fatalf("peers = %q", cfg.Peers)
+	}
+
+	env = map[string]string{"EPHEMERAL_PORT": "lots"}
+	if err := config.Default().ApplyEnv(lookup); err == nil || !strings.Contains(err.Error(), "EPHEMERAL_PORT") {
+		t.Fatalf("bad value: %v", err)
+	}
+	env = map[string]string{"EPHEMERAL_ROOMS": "ops"}
+	if err := config.Default().ApplyEnv(lookup); err == nil {
+		t.Fatal("rooms set from the environment")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*config.Config){
+		"encrypted without password":  func(c *config.Config) { c.Rooms = append(c.Rooms, config.RoomConfig{Name: "ops", Encrypted: true}) },
+		"password without encryption": func(c *config.Config) { c.Rooms = append(c.Rooms, config.RoomConfig{Name: "ops", Password: "x"}) },
+		"encrypted global":            func(c *config.Config) { c.Rooms[0] = config.RoomConfig{Name: "global", Encrypted: true, Password: "x"} },
+		"persisted keys":              func(c *config.Config) { c.Security.PersistKeys = true },
+	} {
+		cfg := config.Default()
+		mutate(cfg)
+		if cfg.Validate() == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"ephemeral/internal/control"
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// controlLine is either a response or an event.
+type controlLine struct {
+	control.Response
+	Event   string           `json:"event"`
+	Message *control.Message `json:"message"`
+	Peer    *control.Peer    `json:"peer"`
+}
+
+type controlClient struct {
+	conn net.Conn
+	sc   *bufio.Scanner
+}
+
+func (c *controlClient) call(t *testing.T, req control.Request) controlLine {
+	t.Helper()
+	req.ID = json.RawMessage(`"` + req.Method + `"`)
+	data, _ := json.Marshal(req)
+	c.conn.Write(append(data, '\n'))
+	for {
+		l := c.next(t)
+		if l.Event == "" {
+			if string(l.ID) != string(req.ID) {
+				t.Fatalf("Expected the response to %s, got %s", req.ID, l.ID)
+			}
+			return l
+		}
+	}
+}
+
+func (c *controlClient) next(t *testing.T) controlLine {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if !c.sc.Scan() {
+		t.Fatalf("Control socket closed: %v", c.sc.Err())
+	}
+	var l controlLine
+	if err := json.Unmarshal(c.sc.Bytes(), &l); err != nil {
+		t.Fatalf("Bad line %q: %v", c.sc.Text(), err)
+	}
+	return l
+}
+
+func (c *controlClient) nextEvent(t *testing.T, event string) controlLine {
+	t.Helper()
+	for {
+		if l := c.next(t); l.Event == event {
+			return l
+		}
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	n := node.New(room.NewManager("Alice", "peerA"), trA, nil, nil)
+	n.Start()
+	defer n.Stop()
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	api := control.New(n)
+	if err := api.Listen(path); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer api.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a socket only its owner can use, got %v %v", fi.Mode(), err)
+	}
+	if err := control.New(n).Listen(path); err == nil {
+		t.Error("Expected a second server on a live socket to fail")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	c := &controlClient{conn: conn, sc: bufio.NewScanner(conn)}
+
+	if l := c.call(t, control.Request{Method: "join", Room: "ops", Password: "hunter2"}); !l.OK {
+		t.Fatalf("Join failed: %s", l.Error)
+	}
+	if cur := n.Rooms.CurrentName(); cur != "global" {
+		t.Errorf("Expected a script's join to leave the current room alone, got %s", cur)
+	}
+	if l := c.call(t, control.Request{Method: "subscribe", Rooms: []string{"ops"}}); !l.OK {
+		t.Fatalf("Subscribe failed: %s", l.Error)
+	}
+
+	key, _ := room.RoomKey("ops", "hunter2")
+	rmB := room.NewManager("Bob", "peerB")
+	rmB.Join("ops", true, key)
+	trB.Subscribe("ops")
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if l := c.nextEvent(t, "peer_up"); l.Peer.Nick != "Bob" {
+		t.Errorf("Expected Bob to come up, got %+v", l.Peer)
+	}
+	waitFor(t, 2*time.Second, "Bob's subscription", func() bool {
+		p := trA.Peers()
+		return len(p) == 1 && contains(p[0].Rooms, "ops")
+	})
+
+	l := c.call(t, control.Request{Method: "send", Room: "ops", Text: "deploy finished", Bot: true})
+	if !l.OK {
+		t.Fatalf("Send failed: %s", l.Error)
+	}
+	select {
+	case env := <-trB.Incoming():
+		opened, err := rmB.Open(env)
+		if err != nil || opened.Payload != "deploy finished" || !opened.Bot {
+			t.Errorf("Expected Bob to read the sealed bot reply, got %+v (%v)", opened, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for the message")
+	}
+
+	sealed, _ := rmB.Seal(protocol.NewEnvelope("b1", "peerB", "Bob", "ops", protocol.TypeChat, "thanks"))
+	trB.Broadcast(sealed)
+	trB.Broadcast(protocol.NewEnvelope("b2", "peerB", "Bob", "global", protocol.TypeChat, "filtered out"))
+	for {
+		ev := c.nextEvent(t, "message")
+		if ev.Message.Self {
+			continue
+		}
+		if ev.Message.Room != "ops" || ev.Message.Text != "thanks" {
+			t.Errorf("Expected only Bob's ops message, got %+v", ev.Message)
+		}
+		break
+	}
+
+	if l := c.call(t, control.Request{Method: "history", Room: "ops"}); !l.OK {
+		t.Errorf("History failed: %s", l.Error)
+	}
+	if l := c.call(t, control.Request{Method: "send", Room: "nowhere", Text: "x"}); l.OK || l.Error == "" {
+		t.Errorf("Expected sending to an unjoined room to fail, got %+v", l)
+	}
+	if l := c.call(t, control.Request{Method: "frobnicate"}); l.OK {
+		t.Error("Expected an unknown method to fail")
+	}
+
+	api.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected Close to remove the socket, got %v", err)
+	}
+}
+
+func TestHeadlessSessionOutlivesInput(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	n := node.New(room.NewManager("Alice", "peerA"), trA, nil, nil)
+	n.Start()
+	defer n.Stop()
+
+	api := control.New(n)
+	stdin, feed := io.Pipe()
+	stdout, out := io.Pipe()
+	served := make(chan struct{})
+	go func() {
+		api.Serve(stdin, out, true)
+		close(served)
+	}()
+	lines := bufio.NewScanner(stdout)
+	next := func() controlLine {
+		t.Helper()
+		got := make(chan controlLine, 1)
+		go func() {
+			var l controlLine
+			if lines.Scan() {
+				json.Unmarshal(lines.Bytes(), &l)
+			}
+			got <- l
+		}()
+		select {
+		case l := <-got:
+			return l
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for output")
+		}
+		return controlLine{}
+	}
+
+	feed.Write([]byte(`{"id":1,"method":"join","room":"ops"}` + "\n"))
+	if l := next(); !l.OK || string(l.ID) != "1" {
+		t.Fatalf("Expected the join to succeed, got %+v", l)
+	}
+	feed.Close()
+
+	// Events keep coming once the input is gone.
+	trB.Subscribe("ops")
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if l := next(); l.Event != "peer_up" || l.Peer.ID != "peerB" {
+		t.Fatalf("Expected Bob to come up, got %+v", l)
+	}
+	trB.Broadcast(protocol.NewEnvelope("b1", "peerB", "Bob", "ops", protocol.TypeChat, "still listening?"))
+	if l := next(); l.Event != "message" || l.Message.Text != "still listening?" {
+		t.Fatalf("Expected Bob's message, got %+v", l)
+	}
+
+	go io.Copy(io.Discard, stdout)
+	api.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the session to end with the server")
+	}
+}
+
+func TestSlowSubscriberIsToldWhatItMissed(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	tr := transport.NewMemory(network, "a", "peerA", "Alice")
+	n := node.New(room.NewManager("Alice", "peerA"), tr, nil, nil)
+	events, cancel := n.Subscribe()
+	defer cancel()
+
+	const sent = 300
+	for i := 0; i < sent; i++ {
+		n.Notice("global", fmt.Sprintf("line %d", i))
+	}
+	received := 0
+	for len(events) > 0 {
+		<-events
+		received++
+	}
+	n.Notice("global", "after")
+
+	ev := <-events
+	if ev.Kind != node.Dropped || ev.Count != sent-received {
+		t.Fatalf("Expected a drop report of %d, got %+v", sent-received, ev)
+	}
+	if ev := <-events; ev.Kind != node.Message || ev.Message.Payload != "after" {
+		t.Fatalf("Expected the next message after the report, got %+v", ev)
+	}
+}
@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"ephemeral/internal/doctor"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDoctorLoopbackHandshake(t *testing.T) {
+	f := doctor.Handshake(2 * time.Second)
+	if f.Status != doctor.OK {
+		t.Fatalf("handshake: %s: %s", f.Status, f.Detail)
+	}
+}
+
+func TestDoctorReportsBusyPort(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	f := doctor.TCPPort(port)
+	if f.Status != doctor.Fail || f.Fix == "" {
+		t.Fatalf("busy port reported as %s (%q, fix %q)", f.Status, f.Detail, f.Fix)
+	}
+	ln.Close()
+	if f := doctor.TCPPort(port); f.Status != doctor.OK {
+		t.Fatalf("free port reported as %s: %s", f.Status, f.Detail)
+	}
+}
@@ -0,0 +1,279 @@
+package tests
+
+import (
+	"ephemeral/internal/overlay"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/relay"
+	"ephemeral/internal/transport"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGossipReachesEveryNode(t *testing.T) {
+	const n = 12
+	cfg := overlay.DefaultConfig()
+	cfg.Mode = overlay.ModeGossip
+	cfg.ActiveSize = 3
+	cfg.GraftTimeout = 100 * time.Millisecond
+
+	network := transport.NewMemoryNetwork()
+	nodes := make([]*overlay.Gossip, n)
+	for i := range nodes {
+		id := fmt.Sprintf("peer%d", i)
+		nodes[i] = overlay.New(transport.NewMemory(network, id, id, id), id, id, cfg)
+		if err := nodes[i].Start(); err != nil {
+			t.Fatalf("Start %s failed: %v", id, err)
+		}
+		defer nodes[i].Stop()
+	}
+
+	// Every node "discovers" every other one, as on a LAN.
+	for i, g := range nodes {
+		for k := 1; k < n; k++ {
+			id := fmt.Sprintf("peer%d", (i+k)%n)
+			g.Dial(id, id)
+		}
+	}
+	waitFor(t, 5*time.Second, "active views to settle", func() bool {
+		for _, g := range nodes {
+			if v := len(g.ActiveView()); v == 0 || v > cfg.ActiveSize+1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	for round := 0; round < 3; round++ {
+		id := fmt.Sprintf("msg%d", round)
+		nodes[round].Broadcast(protocol.NewEnvelope(id, fmt.Sprintf("peer%d", round), "x", "global", protocol.TypeChat, id))
+		for i, g := range nodes {
+			if i == round {
+				continue
+			}
+			expectChat(t, g, id)
+		}
+	}
+
+	// A room only its two ends are in still crosses the nodes between
+	// them, which forward every room while gossiping.
+	nodes[0].Subscribe("ops")
+	nodes[n-1].Subscribe("ops")
+	time.Sleep(100 * time.Millisecond)
+	nodes[0].Broadcast(protocol.NewEnvelope("ops1", "peer0", "x", "ops", protocol.TypeChat, "ops1"))
+	expectChat(t, nodes[n-1], "ops1")
+}
+
+func TestMeshModeDoesNotCapPeers(t *testing.T) {
+	cfg := overlay.DefaultConfig()
+	cfg.Mode = overlay.ModeMesh
+	cfg.ActiveSize = 1
+
+	network := transport.NewMemoryNetwork()
+	nodes := make([]*overlay.Gossip, 4)
+	for i := range nodes {
+		id := fmt.Sprintf("peer%d", i)
+		nodes[i] = overlay.New(transport.NewMemory(network, id, id, id), id, id, cfg)
+		if err := nodes[i].Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer nodes[i].Stop()
+	}
+	for k := 1; k < len(nodes); k++ {
+		id := fmt.Sprintf("peer%d", k)
+		if err := nodes[0].Dial(id, id); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+	}
+	waitFor(t, 2*time.Second, "full mesh", func() bool { return len(nodes[0].ActiveView()) == 3 })
+
+	nodes[0].Broadcast(protocol.NewEnvelope("m1", "peer0", "peer0", "global", protocol.TypeChat, "hello all"))
+	for _, g := range nodes[1:] {
+		expectChat(t, g, "hello all")
+	}
+}
+
+func TestGossipBoundsMissingAnnouncements(t *testing.T) {
+	cfg := overlay.DefaultConfig()
+	cfg.Mode = overlay.ModeGossip
+	cfg.GraftTimeout = 50 * time.Millisecond
+	cfg.CacheSize = 20
+
+	network := transport.NewMemoryNetwork()
+	g := overlay.New(transport.NewMemory(network, "gossip", "gossip", "gossip"), "gossip", "gossip", cfg)
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	flood := transport.NewMemory(network, "flood", "flood", "flood")
+	if err := flood.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer flood.Stop()
+	flood.Dial("gossip", "gossip")
+	waitFor(t, 2*time.Second, "link", func() bool { return len(flood.Peers()) == 1 })
+
+	ihave := func(ids ...string) {
+		env := protocol.NewControl(fmt.Sprintf("ihave-%s", ids[0]), "flood", "flood", protocol.Control{Op: protocol.ControlIHave, IDs: ids})
+		if err := flood.Send("gossip", env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// grafted collects the IDs pulled from us until quiet for a while.
+	grafted := func() map[string]bool {
+		ids := make(map[string]bool)
+		for {
+			select {
+			case env := <-flood.Incoming():
+				if c, err := protocol.ParseControl(env); err == nil && c.Op == protocol.ControlGraft {
+					for _, id := range c.IDs {
+						ids[id] = true
+					}
+				}
+			case <-time.After(10 * cfg.GraftTimeout):
+				return ids
+			}
+		}
+	}
+
+	var ids []string
+	for i := 0; i < 500; i++ {
+		ids = append(ids, fmt.Sprintf("never-%d", i))
+	}
+	ihave(ids...)
+	if got := grafted(); len(got) == 0 || len(got) > cfg.CacheSize {
+		t.Fatalf("grafted %d of 500 announced messages, want 1..%d", len(got), cfg.CacheSize)
+	}
+
+	// Entries that could not be repaired expire and free the table.
+	ihave("late")
+	if got := grafted(); !got["late"] {
+		t.Fatalf("announcement after expiry not pulled: %v", got)
+	}
+}
+
+// countingTransport counts the chat envelopes its mesh receives, copies
+// included, before the overlay drops duplicates.
+type countingTransport struct {
+	*transport.Mesh
+	in    chan protocol.Envelope
+	chats atomic.Int32
+}
+
+func newCountingTransport(m *transport.Mesh) *countingTransport {
+	c := &countingTransport{Mesh: m, in: make(chan protocol.Envelope, 100)}
+	go func() {
+		for env := range m.Incoming() {
+			if env.Type == protocol.TypeChat {
+				c.chats.Add(1)
+			}
+			c.in <- env
+		}
+	}()
+	return c
+}
+
+func (c *countingTransport) Incoming() <-chan protocol.Envelope { return c.in }
+
+func TestMeshNodesDoNotRefloodRelayedMessages(t *testing.T) {
+	const n = 5
+	cfg := overlay.DefaultConfig()
+	cfg.Mode = overlay.ModeMesh
+
+	network := transport.NewMemoryNetwork()
+	trR := transport.NewMemory(network, "relay", "relay", "relay")
+	if err := trR.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer trR.Stop()
+	r := relay.New(trR)
+	r.Start()
+	defer r.Stop()
+
+	inners := make([]*countingTransport, n)
+	nodes := make([]*overlay.Gossip, n)
+	for i := range nodes {
+		id := fmt.Sprintf("peer%d", i)
+		inners[i] = newCountingTransport(transport.NewMemory(network, id, id, id))
+		nodes[i] = overlay.New(inners[i], id, id, cfg)
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Stop()
+	}
+	// A full LAN mesh whose members also register with a relay.
+	for i, g := range nodes {
+		g.Dial("relay", "relay")
+		for k := i + 1; k < n; k++ {
+			id := fmt.Sprintf("peer%d", k)
+			g.Dial(id, id)
+		}
+	}
+	waitFor(t, 2*time.Second, "full mesh", func() bool {
+		for _, g := range nodes {
+			if len(g.Peers()) != n {
+				return false
+			}
+		}
+		return len(trR.Peers()) == n
+	})
+
+	nodes[0].Broadcast(protocol.NewEnvelope("m1", "peer0", "peer0", "global", protocol.TypeChat, "once"))
+	for _, g := range nodes[1:] {
+		expectChat(t, g, "once")
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Each peer hears the message from its author and from the relay.
+	for i, c := range inners[1:] {
+		if got := c.chats.Load(); got > 2 {
+			t.Errorf("peer%d received %d copies, want at most 2", i+1, got)
+		}
+	}
+	if got := inners[0].chats.Load(); got != 0 {
+		t.Errorf("The author received %d copies of its own message", got)
+	}
+}
+
+func TestGossipPushesOnlyToSubscribers(t *testing.T) {
+	cfg := overlay.DefaultConfig()
+	cfg.Mode = overlay.ModeGossip
+
+	network := transport.NewMemoryNetwork()
+	g := overlay.New(transport.NewMemory(network, "gossip", "gossip", "gossip"), "gossip", "gossip", cfg)
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	member := transport.NewMemory(network, "member", "member", "member")
+	other := transport.NewMemory(network, "other", "other", "other")
+	for _, tr := range []*transport.Mesh{member, other} {
+		if err := tr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Stop()
+		if err := tr.Dial("gossip", "gossip"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	member.Subscribe("ops")
+	waitFor(t, 2*time.Second, "the member's subscription", func() bool {
+		for _, p := range g.Peers() {
+			if p.ID == "member" && contains(p.Rooms, "ops") {
+				return len(g.Peers()) == 2
+			}
+		}
+		return false
+	})
+
+	g.Broadcast(protocol.NewEnvelope("m1", "gossip", "gossip", "ops", protocol.TypeChat, "ops only"))
+	expectChat(t, member, "ops only")
+	select {
+	case env := <-other.Incoming():
+		if env.Type == protocol.TypeChat {
+			t.Errorf("A peer outside the room received %q", env.Payload)
+		}
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"encoding/json"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for %s", what)
+}
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	trA := transport.NewTCP(0, "peerA", "Alice")
+	trA.Heartbeat = 50 * time.Millisecond
+	if err := trA.Start(); err != nil {
+		t.Fatalf("Start A failed: %v", err)
+	}
+	defer trA.Stop()
+
+	trB := transport.NewTCP(0, "peerB", "Bob")
+	if err := trB.Start(); err != nil {
+		t.Fatalf("Start B failed: %v", err)
+	}
+	defer trB.Stop()
+
+	if err := trA.Dial("peerB", fmt.Sprintf("127.0.0.1:%d", transport.Port(trB))); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	waitFor(t, 2*time.Second, "RTT to Bob", func() bool {
+		for _, p := range trA.Peers() {
+			if p.ID == "peerB" && p.Nick == "Bob" && p.RTT > 0 {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestIdlePeerIsDropped(t *testing.T) {
+	tr := transport.NewTCP(0, "peerA", "Alice")
+	tr.Heartbeat = 50 * time.Millisecond
+	tr.IdleTimeout = 200 * time.Millisecond
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	// A raw client that says hello and then never answers pings.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", transport.Port(tr)))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	hello := protocol.NewEnvelope("", "silent", "Silent", "global", protocol.TypePresence, "")
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+
+	waitFor(t, time.Second, "silent peer to register", func() bool {
+		return len(tr.Peers()) == 1
+	})
+	waitFor(t, 2*time.Second, "silent peer to be dropped", func() bool {
+		return len(tr.Peers()) == 0
+	})
+}
@@ -3,28 +3,29 @@ package tests
 import (
 	"ephemeral/internal/protocol"
 	"ephemeral/internal/transport"
+	"fmt"
 	"testing"
 	"time"
 )
 
 func TestTransportExchange(t *testing.T) {
-	trA := transport.New(0, "peerA", "Alice")
+	trA := transport.NewTCP(0, "peerA", "Alice")
 	if err := trA.Start(); err != nil {
 		t.Fatalf("Start A failed: %v", err)
 	}
 	defer trA.Stop()
 
-	trB := transport.New(0, "peerB", "Bob")
+	trB := transport.NewTCP(0, "peerB", "Bob")
 	if err := trB.Start(); err != nil {
 		t.Fatalf("Start B failed: %v", err)
 	}
 	defer trB.Stop()
 
-	if trA.Port == 0 || trB.Port == 0 {
-		t.Fatalf("Ports not assigned: A=%d, B=%d", trA.Port, trB.Port)
+	if transport.Port(trA) == 0 || transport.Port(trB) == 0 {
+		t.Fatalf("Ports not assigned: A=%d, B=%d", transport.Port(trA), transport.Port(trB))
 	}
 
-	if err := trA.Connect("peerB", "127.0.0.1", trB.Port); err != nil {
+	if err := trA.Dial("peerB", fmt.Sprintf("127.0.0.1:%d", transport.Port(trB))); err != nil {
 		t.Fatalf("Connect failed: %v", err)
 	}
 
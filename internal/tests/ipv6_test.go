@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDialFallsBackAcrossAddresses(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	if err := trA.Dial("peerB", "nowhere", "gone", "b"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, trA, transport.PeerUp, "peerB")
+	if err := trA.Dial("peerC", "nowhere", "gone"); err == nil {
+		t.Error("Expected dialling only dead addresses to fail")
+	}
+}
+
+func TestIPv6Transport(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	} else {
+		ln.Close()
+	}
+
+	trA := transport.NewTCP(0, "peerA", "Alice")
+	trB := transport.NewTCP(0, "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	// Nothing listens on the IPv4 address, so only the IPv6 attempt wins.
+	port := transport.Port(trB)
+	if err := trA.Dial("peerB", "127.0.0.1:1", fmt.Sprintf("[::1]:%d", port)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if ev := expectEvent(t, trA, transport.PeerUp, "peerB"); ev.Addr != fmt.Sprintf("[::1]:%d", port) {
+		t.Errorf("Expected the IPv6 address to win, got %s", ev.Addr)
+	}
+	trA.Broadcast(protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, "over v6"))
+	expectChat(t, trB, "over v6")
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"testing"
+	"time"
+)
+
+func TestStopAnnouncesDeparture(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	trB.Subscribe("ops")
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, trA, transport.PeerUp, "peerB")
+	waitFor(t, 2*time.Second, "Bob's subscription", func() bool {
+		p := trA.Peers()
+		return len(p) == 1 && contains(p[0].Rooms, "ops")
+	})
+
+	trB.Stop()
+	ev := expectEvent(t, trA, transport.PeerDown, "peerB")
+	if !ev.Left || ev.Nick != "Bob" || !contains(ev.Rooms, "ops") || !contains(ev.Rooms, "global") {
+		t.Errorf("Expected Bob to leave global and ops, got %+v", ev)
+	}
+}
+
+func TestQuietStopIsAPlainDrop(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	trB.Quiet = true
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, trA, transport.PeerUp, "peerB")
+
+	trB.Stop()
+	if ev := expectEvent(t, trA, transport.PeerDown, "peerB"); ev.Left {
+		t.Errorf("Expected a quiet mesh to drop without leaving, got %+v", ev)
+	}
+}
+
+func TestForgedLeaveIsIgnored(t *testing.T) {
+	tr := transport.NewTCP(0, "peerA", "Alice")
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+
+	hello := protocol.NewHello("mallory", "Mallory", protocol.Hello{Rooms: []string{"global"}, Leave: "00"})
+	raw := dialRawHello(t, transport.Port(tr), hello)
+	defer raw.conn.Close()
+	expectEvent(t, tr, transport.PeerUp, "mallory")
+
+	leave := protocol.NewControl("l1", "mallory", "Mallory", protocol.Control{Op: protocol.ControlLeave})
+	leave.Sig = "not the token"
+	raw.enc.Encode(leave)
+	raw.enc.Encode(protocol.NewEnvelope("m0", "mallory", "Mallory", "global", protocol.TypeChat, "after leave"))
+	expectChat(t, tr, "after leave")
+
+	// The link survives: a chat still reaches Mallory.
+	tr.Broadcast(protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, "still linked"))
+	if env := raw.nextChat(t); env.Payload != "still linked" {
+		t.Errorf("Expected the chat, got %+v", env)
+	}
+	raw.conn.Close()
+	if ev := expectEvent(t, tr, transport.PeerDown, "mallory"); ev.Left {
+		t.Error("Expected a plain drop, not a departure")
+	}
+}
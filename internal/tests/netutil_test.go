@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"ephemeral/internal/netutil"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	if _, err := netutil.NewScope([]string{"fe80::1"}, nil); err == nil {
+		t.Error("Expected a link-local listen address without zone to be rejected")
+	}
+	if _, err := netutil.NewScope(nil, []string{"no-such-iface0"}); err == nil {
+		t.Error("Expected an unknown interface to be rejected")
+	}
+
+	s, err := netutil.NewScope([]string{"127.0.0.1", "fe80::1%eth0"}, nil)
+	if err != nil {
+		t.Fatalf("NewScope failed: %v", err)
+	}
+	want := []string{"127.0.0.1:9999", "[fe80::1%eth0]:9999"}
+	if got := s.ListenAddrs(9999); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := (netutil.Scope{}).ListenAddrs(9999); len(got) != 1 || got[0] != ":9999" {
+		t.Errorf("Expected the wildcard address, got %v", got)
+	}
+
+	_, n, _ := net.ParseCIDR("192.168.1.20/24")
+	if got := netutil.Broadcast(n); !got.Equal(net.ParseIP("192.168.1.255")) {
+		t.Errorf("Expected 192.168.1.255, got %v", got)
+	}
+}
+
+func TestTCPListensOnEveryChosenAddress(t *testing.T) {
+	listen := []string{"127.0.0.1"}
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		ln.Close()
+		listen = append(listen, "::1")
+	}
+	s, err := netutil.NewScope(listen, nil)
+	if err != nil {
+		t.Fatalf("NewScope failed: %v", err)
+	}
+
+	trA := transport.NewTCPOn(s.ListenAddrs(0), "peerA", "Alice")
+	if err := trA.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer trA.Stop()
+	port := transport.Port(trA)
+
+	for i, host := range listen {
+		id := fmt.Sprintf("peer%d", i)
+		tr := transport.NewTCP(0, id, id)
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+		if err := tr.Dial("peerA", net.JoinHostPort(host, fmt.Sprint(port))); err != nil {
+			t.Fatalf("Dial %s failed: %v", host, err)
+		}
+		tr.Broadcast(protocol.NewEnvelope("m"+id, id, id, "global", protocol.TypeChat, "via "+host))
+		expectChat(t, trA, "via "+host)
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRoomsOrderMessagesCausally(t *testing.T) {
+	chat := func(id, from string, clock uint64) protocol.Envelope {
+		env := protocol.NewEnvelope(id, from, from, "global", protocol.TypeChat, id)
+		env.Clock = clock
+		return env
+	}
+	question := chat("question", "peerB", 4)
+	answer := chat("answer", "peerC", 5)
+	// Sent concurrently with the question: same clock, ordered by sender.
+	aside := chat("aside", "peerA", 4)
+
+	alice := room.NewManager("Alice", "me1")
+	for _, env := range []protocol.Envelope{answer, question, aside} {
+		alice.AddMessage(env)
+	}
+	carol := room.NewManager("Carol", "me2")
+	for _, env := range []protocol.Envelope{aside, question, answer} {
+		carol.AddMessage(env)
+	}
+
+	want := []string{"aside", "question", "answer"}
+	for name, rm := range map[string]*room.Manager{"Alice": alice, "Carol": carol} {
+		msgs := rm.GetMessages("global")
+		if len(msgs) != len(want) {
+			t.Fatalf("%s: expected %d messages, got %d", name, len(want), len(msgs))
+		}
+		for i, env := range msgs {
+			if env.ID != want[i] {
+				t.Errorf("%s: message %d is %s, want %s", name, i, env.ID, want[i])
+			}
+		}
+	}
+
+	// A message sent after reading the answer comes after it everywhere.
+	if c := alice.Tick(); c <= answer.Clock {
+		t.Errorf("Expected the clock to pass %d, got %d", answer.Clock, c)
+	}
+}
+
+func TestLateJoinerSortsAfterHistory(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	rmA := room.NewManager("Alice", "peerA")
+	rmB := room.NewManager("Bob", "peerB")
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	trA.Clock, trB.Clock = rmA.Clock, rmB.Clock
+	alice := node.New(rmA, trA, nil, nil)
+	bob := node.New(rmB, trB, nil, nil)
+	for _, n := range []*node.Node{alice, bob} {
+		if err := n.Transport.Start(); err != nil {
+			t.Fatal(err)
+		}
+		n.Start()
+		defer n.Stop()
+		defer n.Transport.Stop()
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, err := alice.Say("global", fmt.Sprintf("old %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "Bob's clock to catch up", func() bool { return rmB.Clock() >= 3 })
+
+	if _, err := bob.Say("global", "new"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "Bob's message at Alice", func() bool { return len(rmA.GetMessages("global")) == 4 })
+	msgs := rmA.GetMessages("global")
+	if last := msgs[len(msgs)-1]; last.Payload != "new" {
+		t.Fatalf("Expected the late joiner's message last, got %q", last.Payload)
+	}
+}
+
+func TestAbsurdClockDoesNotWrap(t *testing.T) {
+	rm := room.NewManager("Alice", "me")
+	first := protocol.NewEnvelope("first", "peerB", "Bob", "global", protocol.TypeChat, "first")
+	first.Clock = 7
+	rm.AddMessage(first)
+	hostile := protocol.NewEnvelope("hostile", "peerE", "Eve", "global", protocol.TypeChat, "hostile")
+	hostile.Clock = ^uint64(0)
+	rm.AddMessage(hostile)
+	rm.Observe(^uint64(0))
+
+	if c := rm.Tick(); c != 8 {
+		t.Fatalf("Expected the clock to ignore the absurd value and tick to 8, got %d", c)
+	}
+	if msgs := rm.GetMessages("global"); msgs[len(msgs)-1].Clock > room.MaxClock {
+		t.Fatalf("Stored an absurd clock: %+v", msgs[len(msgs)-1])
+	}
+}
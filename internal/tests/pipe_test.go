@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"ephemeral/internal/pipe"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestPipeCoalescesAndRateLimits(t *testing.T) {
+	var posts []string
+	var times []time.Time
+	p := pipe.New(func(text string) error {
+		posts = append(posts, text)
+		times = append(times, time.Now())
+		return nil
+	})
+	p.Interval = 50 * time.Millisecond
+	p.MaxBytes = 32
+
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("one\ntwo\r\n\nthree\n"))
+		time.Sleep(120 * time.Millisecond)
+		w.Write([]byte(strings.Repeat("é", 40) + "\nlast"))
+		w.Close()
+	}()
+	if err := p.Run(r); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(posts) < 3 || posts[0] != "one\ntwo\nthree" {
+		t.Fatalf("Expected the first lines joined into one post, got %q", posts)
+	}
+	for i, text := range posts {
+		if len(text) > p.MaxBytes || !utf8.ValidString(text) {
+			t.Errorf("Post %d is %d bytes or not valid UTF-8: %q", i, len(text), text)
+		}
+		if i > 0 && times[i].Sub(times[i-1]) < p.Interval-5*time.Millisecond {
+			t.Errorf("Posts %d and %d only %s apart", i-1, i, times[i].Sub(times[i-1]))
+		}
+	}
+	if all := strings.Join(posts, "\n"); !strings.HasSuffix(all, "last") || strings.Count(all, "é") != 40 {
+		t.Errorf("Expected every byte to be posted, got %q", all)
+	}
+}
+
+func TestPipeStopsWhenPostFails(t *testing.T) {
+	p := pipe.New(func(string) error { return errors.New("not in room") })
+	p.Interval = 10 * time.Millisecond
+	if err := p.Run(strings.NewReader("a\nb\n")); err == nil {
+		t.Error("Expected the post error")
+	}
+}
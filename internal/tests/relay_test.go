@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/relay"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"testing"
+	"time"
+)
+
+func TestRelayForwardsSealedRooms(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trR := transport.NewMemory(network, "relay", "relay", "relay")
+	trA := transport.NewMemory(network, "vlan1/a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "vlan2/b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trR, trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	r := relay.New(trR)
+	r.Start()
+	defer r.Stop()
+
+	// Alice and Bob only know the relay.
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Dial("relay", "relay"); err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		tr.Subscribe("secret")
+	}
+
+	key, _ := room.RoomKey("secret", "hunter2")
+	alice := room.NewManager("Alice", "peerA")
+	alice.Join("secret", true, key)
+	bob := room.NewManager("Bob", "peerB")
+	bob.Join("secret", true, key)
+	eve := room.NewManager("Eve", "peerE")
+	wrong, _ := room.RoomKey("secret", "guess")
+	eve.Join("secret", true, wrong)
+
+	sealed, err := alice.Seal(protocol.NewEnvelope("m1", "peerA", "Alice", "secret", protocol.TypeChat, "meet at noon"))
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if !sealed.Enc || sealed.Payload == "meet at noon" {
+		t.Fatalf("Expected a sealed payload, got %+v", sealed)
+	}
+	waitFor(t, 2*time.Second, "the relay to learn Bob's rooms", func() bool {
+		for _, p := range trR.Peers() {
+			if p.ID == "peerB" && contains(p.Rooms, "secret") {
+				return true
+			}
+		}
+		return false
+	})
+	trA.Broadcast(sealed)
+	var got protocol.Envelope
+	select {
+	case got = <-trB.Incoming():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for the relayed message")
+	}
+	if got.Payload != sealed.Payload {
+		t.Errorf("Relay altered the payload")
+	}
+
+	opened, err := bob.Open(got)
+	if err != nil || opened.Payload != "meet at noon" {
+		t.Errorf("Bob could not open the message: %q, %v", opened.Payload, err)
+	}
+	if _, err := eve.Open(got); err == nil {
+		t.Error("Expected the wrong password to fail")
+	}
+	if _, err := bob.Open(protocol.NewEnvelope("m2", "peerE", "Eve", "secret", protocol.TypeChat, "plain")); err == nil {
+		t.Error("Expected plaintext in an encrypted room to be rejected")
+	}
+
+	// The relay cannot read the payload, nor pass it off as someone
+	// else's or replay it under a new ID or clock.
+	bob.Join("other", true, key)
+	for name, tamper := range map[string]func(*protocol.Envelope){
+		"sender": func(env *protocol.Envelope) { env.From, env.Nick = "peerE", "Eve" },
+		"replay": func(env *protocol.Envelope) { env.ID = "m1-again" },
+		"clock":  func(env *protocol.Envelope) { env.Clock = 99 },
+		"room":   func(env *protocol.Envelope) { env.Room = "other" },
+		"bot":    func(env *protocol.Envelope) { env.Bot = !env.Bot },
+	} {
+		forged := got
+		tamper(&forged)
+		if _, err := bob.Open(forged); err == nil {
+			t.Errorf("Expected a message with a changed %s to be rejected", name)
+		}
+	}
+}
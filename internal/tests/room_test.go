@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"ephemeral/internal/node"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestClearAndRenameWhileReceiving is meant for go test -race: the UI
+// clears rooms and changes its nick while the node adds incoming messages
+// and stamps outgoing ones on other goroutines.
+func TestClearAndRenameWhileReceiving(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	rmA := room.NewManager("Alice", "peerA")
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	alice := node.New(rmA, trA, nil, nil)
+	bob := node.New(room.NewManager("Bob", "peerB"), trB, nil, nil)
+	for _, n := range []*node.Node{alice, bob} {
+		if err := n.Transport.Start(); err != nil {
+			t.Fatal(err)
+		}
+		n.Start()
+		defer n.Stop()
+		defer n.Transport.Stop()
+	}
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the link", func() bool { return len(trA.Peers()) == 1 })
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			bob.Say("global", fmt.Sprintf("bob %d", i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			alice.Say("global", fmt.Sprintf("alice %d", i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		rmA.ClearMessages("global")
+		rmA.SetNick(fmt.Sprintf("Alice%d", i))
+		rmA.GetMessages("global")
+	}
+	wg.Wait()
+
+	if nick := rmA.Nick(); nick != "Alice99" {
+		t.Errorf("Expected the last nick, got %s", nick)
+	}
+}
@@ -0,0 +1,40 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"testing"
+	"time"
+)
+
+func TestStaticPeerIsKeptConnected(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	if err := trA.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer trA.Stop()
+
+	// Bob is not up yet; Persist keeps trying until he is.
+	trA.Persist("b")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	if err := trB.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if ev := expectEventWithin(t, trA, transport.PeerUp, "peerB", 5*time.Second); !ev.Static {
+		t.Error("Expected the static flag on Bob's PeerUp")
+	}
+
+	// Bob restarts under a new identity on the same address.
+	trB.Stop()
+	expectEvent(t, trA, transport.PeerDown, "peerB")
+	trB2 := transport.NewMemory(network, "b", "peerB2", "Bob")
+	if err := trB2.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer trB2.Stop()
+	expectEventWithin(t, trA, transport.PeerUp, "peerB2", 5*time.Second)
+
+	trA.Broadcast(protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, "still here"))
+	expectChat(t, trB2, "still here")
+}
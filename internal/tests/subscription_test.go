@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"testing"
+	"time"
+)
+
+func TestRoomTrafficOnlyReachesSubscribers(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := transport.NewMemory(network, "a", "peerA", "Alice")
+	bob := transport.NewMemory(network, "b", "peerB", "Bob")
+	carol := transport.NewMemory(network, "c", "peerC", "Carol")
+	for _, tr := range []*transport.Mesh{alice, bob, carol} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	// Bob joins before connecting (announced in the hello), Carol after.
+	bob.Subscribe("ops")
+	for _, addr := range []string{"b", "c"} {
+		if err := alice.Dial("", addr); err != nil {
+			t.Fatalf("Dial %s failed: %v", addr, err)
+		}
+	}
+	alice.Subscribe("ops")
+	carol.Subscribe("ops")
+	carol.Unsubscribe("ops")
+
+	waitFor(t, time.Second, "subscriptions to propagate", func() bool {
+		for _, p := range alice.Peers() {
+			if p.ID == "peerB" && !contains(p.Rooms, "ops") {
+				return false
+			}
+			if p.ID == "peerC" && contains(p.Rooms, "ops") {
+				return false
+			}
+		}
+		return len(alice.Peers()) == 2
+	})
+
+	alice.Broadcast(protocol.NewEnvelope("m1", "peerA", "Alice", "ops", protocol.TypeChat, "deploying"))
+	alice.Broadcast(protocol.NewEnvelope("m2", "peerA", "Alice", "global", protocol.TypeChat, "hello everyone"))
+
+	expectChat(t, bob, "deploying")
+	expectChat(t, carol, "hello everyone")
+	select {
+	case env := <-carol.Incoming():
+		t.Fatalf("Carol should not get more traffic, got %q", env.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if st, _ := alice.Delivery("m1"); st.Pending+st.Acked != 1 {
+		t.Errorf("Expected m1 to be tracked for one peer, got %+v", st)
+	}
+}
+
+func TestManagerIgnoresUnjoinedRooms(t *testing.T) {
+	rm := room.NewManager("Alice", "peerA")
+	if rm.AddMessage(protocol.NewEnvelope("m1", "peerB", "Bob", "secret", protocol.TypeChat, "hi")) {
+		t.Error("Message for an unjoined room was stored")
+	}
+	if rm.Joined("secret") {
+		t.Error("Room was materialised by an incoming message")
+	}
+
+	rm.Join("secret", false, nil)
+	env := protocol.NewEnvelope("m2", "peerB", "Bob", "secret", protocol.TypeChat, "hi")
+	if !rm.AddMessage(env) || rm.AddMessage(env) {
+		t.Error("Expected the first copy to be stored and the duplicate dropped")
+	}
+	if !rm.Leave("secret") || rm.Joined("secret") || rm.CurrentRoom != "global" {
+		t.Error("Leave did not drop the room")
+	}
+	if rm.Leave("global") {
+		t.Error("The global room must not be left")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
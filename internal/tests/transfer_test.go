@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transfer"
+	"ephemeral/internal/transport"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type fileNode struct {
+	tr    *transport.Mesh
+	rooms *room.Manager
+	xfer  *transfer.Manager
+}
+
+// newFileNode starts a node whose file envelopes are handed to its
+// transfer manager, as the TUI does.
+func newFileNode(t *testing.T, network *transport.MemoryNetwork, addr, id, nick string) *fileNode {
+	t.Helper()
+	tr := transport.NewMemory(network, addr, id, nick)
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	n := &fileNode{tr: tr, rooms: room.NewManager(nick, id)}
+	n.xfer = transfer.New(tr, n.rooms)
+	t.Cleanup(func() {
+		tr.Stop()
+		n.xfer.Close()
+	})
+	go func() {
+		for env := range tr.Incoming() {
+			if env.Type == protocol.TypeFile {
+				n.xfer.Handle(env)
+			}
+		}
+	}()
+	return n
+}
+
+func expectTransfer(t *testing.T, n *fileNode, kind transfer.EventKind) transfer.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-n.xfer.Events():
+			if ev.Kind == kind {
+				return ev
+			}
+			if ev.Kind == transfer.Failed {
+				t.Fatalf("Transfer failed: %v", ev.Err)
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for transfer event %d", kind)
+		}
+	}
+}
+
+func TestSendFileIntoEncryptedRoomAndResume(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newFileNode(t, network, "a", "peerA", "Alice")
+	bob := newFileNode(t, network, "b", "peerB", "Bob")
+	key, _ := room.RoomKey("ops", "hunter2")
+	alice.rooms.Join("ops", true, key)
+	bob.rooms.Join("ops", true, key)
+	if err := bob.tr.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, alice.tr, transport.PeerUp, "peerB")
+
+	content := make([]byte, 3*transfer.ChunkSize+100)
+	rand.Read(content)
+	src := filepath.Join(t.TempDir(), "dump.bin")
+	os.WriteFile(src, content, 0o644)
+
+	dir := t.TempDir()
+	id, err := alice.xfer.Offer("peerB", "Bob", src, "ops")
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	offer := expectTransfer(t, bob, transfer.Offered)
+	if offer.ID != id || offer.Name != "dump.bin" || offer.Size != int64(len(content)) || offer.Nick != "Alice" {
+		t.Fatalf("Unexpected offer %+v", offer)
+	}
+	parts, _ := filepath.Glob(filepath.Join(dir, ".dump.bin.*.part"))
+	if len(parts) != 0 {
+		t.Fatal("Partial file created before accepting")
+	}
+	if err := bob.xfer.Accept(id, dir); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	done := expectTransfer(t, bob, transfer.Done)
+	got, err := os.ReadFile(done.Path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Received file differs (%v)", err)
+	}
+	if filepath.Dir(done.Path) != dir {
+		t.Errorf("Expected the file in %s, got %s", dir, done.Path)
+	}
+	expectTransfer(t, alice, transfer.Done)
+
+	// Offered again after an interrupted attempt left the first chunk
+	// behind, only the rest moves.
+	os.Remove(done.Path)
+	sum := sha256.Sum256(content)
+	partial := filepath.Join(dir, ".dump.bin."+hex.EncodeToString(sum[:])[:12]+".part")
+	os.WriteFile(partial, content[:transfer.ChunkSize], 0o600)
+	id, _ = alice.xfer.Offer("peerB", "Bob", src, "ops")
+	expectTransfer(t, bob, transfer.Offered)
+	bob.xfer.Accept(id, dir)
+	if ev := expectTransfer(t, alice, transfer.Progress); ev.Bytes <= transfer.ChunkSize {
+		t.Errorf("Expected sending to start past the partial copy, got %d bytes", ev.Bytes)
+	}
+	done = expectTransfer(t, bob, transfer.Done)
+	if got, _ := os.ReadFile(done.Path); !bytes.Equal(got, content) {
+		t.Error("Resumed file differs")
+	}
+}
+
+func TestOffersNeedTheRoomKey(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newFileNode(t, network, "a", "peerA", "Alice")
+	eve := newFileNode(t, network, "e", "peerE", "Eve")
+	key, _ := room.RoomKey("ops", "hunter2")
+	alice.rooms.Join("ops", true, key)
+	if err := eve.tr.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, alice.tr, transport.PeerUp, "peerE")
+
+	src := filepath.Join(t.TempDir(), "secret.txt")
+	os.WriteFile(src, []byte("launch codes"), 0o644)
+	if _, err := alice.xfer.Offer("peerE", "Eve", src, "ops"); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	select {
+	case ev := <-eve.xfer.Events():
+		t.Errorf("Expected Eve to see nothing, got %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPendingOffersAreBoundedAndExpire(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newFileNode(t, network, "a", "peerA", "Alice")
+	bob := newFileNode(t, network, "b", "peerB", "Bob")
+	if err := bob.tr.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, alice.tr, transport.PeerUp, "peerB")
+
+	src := filepath.Join(t.TempDir(), "spam.txt")
+	os.WriteFile(src, []byte("spam"), 0o644)
+	var ids []string
+	for i := 0; i <= transfer.MaxOffersPerPeer; i++ {
+		id, err := alice.xfer.Offer("peerB", "Bob", src, "global")
+		if err != nil {
+			t.Fatalf("Offer failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	for i := 0; i < transfer.MaxOffersPerPeer; i++ {
+		expectTransfer(t, bob, transfer.Offered)
+	}
+	if ev := expectTransfer(t, alice, transfer.Rejected); ev.ID != ids[transfer.MaxOffersPerPeer] {
+		t.Fatalf("Expected the offer over the bound to be rejected, got %s", ev.ID)
+	}
+
+	bob.xfer.OfferTTL = 50 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	if err := bob.xfer.Accept(ids[0], t.TempDir()); err == nil {
+		t.Fatal("Expected an expired offer to be gone")
+	}
+	for i := 0; i < transfer.MaxOffersPerPeer; i++ {
+		expectTransfer(t, alice, transfer.Rejected)
+	}
+}
+
+func TestOffersToNodesWithoutTransfersAreDeclined(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newFileNode(t, network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	if err := trB.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer trB.Stop()
+	// Like headless mode and the one-shot commands: nobody to accept.
+	bob := node.New(room.NewManager("Bob", "peerB"), trB, nil, nil)
+	bob.Start()
+	defer bob.Stop()
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	expectEvent(t, alice.tr, transport.PeerUp, "peerB")
+
+	src := filepath.Join(t.TempDir(), "note.txt")
+	os.WriteFile(src, []byte("note"), 0o644)
+	id, err := alice.xfer.Offer("peerB", "Bob", src, "global")
+	if err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	if ev := expectTransfer(t, alice, transfer.Rejected); ev.ID != id {
+		t.Fatalf("Expected %s to be declined, got %s", id, ev.ID)
+	}
+
+	// Nobody reads Alice's events from here on; the ones that do not fit
+	// are dropped rather than parked on goroutines.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if _, err := alice.xfer.Offer("peerB", "Bob", src, "global"); err != nil {
+			t.Fatalf("Offer failed: %v", err)
+		}
+	}
+	events := alice.xfer.Events()
+	waitFor(t, 2*time.Second, "the event buffer to fill", func() bool { return len(events) == cap(events) })
+	time.Sleep(200 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("Expected undelivered events to be dropped, goroutines grew from %d to %d", before, after)
+	}
+}
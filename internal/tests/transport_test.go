@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/transport"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChat(t *testing.T, tr transport.Transport, payload string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-tr.Incoming():
+			if msg.Type == protocol.TypeChat && msg.Payload == payload {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for %q", payload)
+		}
+	}
+}
+
+func expectEvent(t *testing.T, tr transport.Transport, typ transport.PeerEventType, id string) transport.PeerEvent {
+	t.Helper()
+	return expectEventWithin(t, tr, typ, id, 2*time.Second)
+}
+
+func expectEventWithin(t *testing.T, tr transport.Transport, typ transport.PeerEventType, id string, d time.Duration) transport.PeerEvent {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case ev := <-tr.Events():
+			if ev.Type == typ && ev.ID == id {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for event %v from %s", typ, id)
+		}
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	// The dialer learns Bob's identity from the handshake.
+	if err := trA.Dial("", "b"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if ev := expectEvent(t, trA, transport.PeerUp, "peerB"); ev.Nick != "Bob" {
+		t.Errorf("Expected nick Bob, got %q", ev.Nick)
+	}
+	expectEvent(t, trB, transport.PeerUp, "peerA")
+
+	if err := trA.Send("peerB", protocol.NewEnvelope("m1", "peerA", "Alice", "global", protocol.TypeChat, "direct")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	expectChat(t, trB, "direct")
+
+	trB.Broadcast(protocol.NewEnvelope("m2", "peerB", "Bob", "global", protocol.TypeChat, "broadcast"))
+	expectChat(t, trA, "broadcast")
+
+	trB.Stop()
+	expectEvent(t, trA, transport.PeerDown, "peerB")
+
+	if err := trA.Dial("", "nowhere"); err == nil {
+		t.Error("Expected dialling an unknown address to fail")
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir := t.TempDir()
+	trA := transport.NewUnix(filepath.Join(dir, "a.sock"), "peerA", "Alice")
+	trB := transport.NewUnix(filepath.Join(dir, "b.sock"), "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+
+	if err := trB.Dial("peerA", filepath.Join(dir, "a.sock")); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	trB.Broadcast(protocol.NewEnvelope("m1", "peerB", "Bob", "global", protocol.TypeChat, "over unix"))
+	expectChat(t, trA, "over unix")
+
+	// A second listener on a live socket must not steal it.
+	if err := transport.NewUnix(filepath.Join(dir, "a.sock"), "peerC", "Carol").Start(); err == nil {
+		t.Error("Expected listening on an in-use socket to fail")
+	}
+}
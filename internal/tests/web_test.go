@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"ephemeral/internal/web"
+	"ephemeral/website"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type wsFrame struct {
+	Op       string    `json:"op"`
+	Room     string    `json:"room,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Nick     string    `json:"nick,omitempty"`
+	Self     bool      `json:"self,omitempty"`
+	Rooms    []string  `json:"rooms,omitempty"`
+	Peers    []string  `json:"peers,omitempty"`
+	Messages []wsFrame `json:"messages,omitempty"`
+}
+
+func nextFrame(t *testing.T, ws *websocket.Conn, op string) wsFrame {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var f wsFrame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			t.Fatalf("Waiting for %s: %v", op, err)
+		}
+		if f.Op == op {
+			return f
+		}
+	}
+}
+
+func TestWebGatewayBridgesBrowserAndMesh(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	trA := transport.NewMemory(network, "a", "peerA", "Alice")
+	trB := transport.NewMemory(network, "b", "peerB", "Bob")
+	for _, tr := range []*transport.Mesh{trA, trB} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer tr.Stop()
+	}
+	n := node.New(room.NewManager("Alice", "peerA"), trA, nil, nil)
+	n.Start()
+	defer n.Stop()
+
+	srv := httptest.NewServer(web.New(n, website.FS))
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+	if f := nextFrame(t, ws, "welcome"); f.Nick != "Alice" || !contains(f.Rooms, "global") {
+		t.Fatalf("Unexpected welcome %+v", f)
+	}
+
+	trB.Subscribe("ops")
+	if err := trB.Dial("peerA", "a"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if f := nextFrame(t, ws, "peers"); !contains(f.Peers, "Bob") {
+		t.Fatalf("Expected Bob among the peers, got %+v", f)
+	}
+	waitFor(t, 2*time.Second, "Bob's subscription", func() bool {
+		p := trA.Peers()
+		return len(p) == 1 && contains(p[0].Rooms, "ops")
+	})
+
+	websocket.JSON.Send(ws, wsFrame{Op: "join", Room: "ops"})
+	if f := nextFrame(t, ws, "history"); f.Room != "ops" {
+		t.Fatalf("Expected the history of ops, got %+v", f)
+	}
+
+	websocket.JSON.Send(ws, wsFrame{Op: "say", Room: "ops", Text: "from the browser"})
+	if f := nextFrame(t, ws, "message"); !f.Self || f.Text != "from the browser" {
+		t.Errorf("Expected our own message echoed, got %+v", f)
+	}
+	expectChat(t, trB, "from the browser")
+
+	trB.Broadcast(protocol.NewEnvelope("b1", "peerB", "Bob", "ops", protocol.TypeChat, "from the mesh"))
+	if f := nextFrame(t, ws, "message"); f.Self || f.Nick != "Bob" || f.Room != "ops" || f.Text != "from the mesh" {
+		t.Errorf("Expected Bob's message, got %+v", f)
+	}
+}
+
+func TestWebGatewayRejectsForeignOrigins(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	tr := transport.NewMemory(network, "a", "peerA", "Alice")
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer tr.Stop()
+	n := node.New(room.NewManager("Alice", "peerA"), tr, nil, nil)
+	n.Start()
+	defer n.Stop()
+
+	srv := httptest.NewServer(web.New(n, website.FS))
+	defer srv.Close()
+
+	url := strings.Replace(srv.URL, "http", "ws", 1) + "/ws"
+	if ws, err := websocket.Dial(url, "", "http://evil.example"); err == nil {
+		ws.Close()
+		t.Error("Expected a cross-origin WebSocket to be refused")
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != web.Page || resp.StatusCode != 200 {
+		t.Errorf("Expected / to lead to the chat page, got %d %s", resp.StatusCode, resp.Request.URL.Path)
+	}
+}
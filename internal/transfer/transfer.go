@@ -0,0 +1,619 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"ephemeral/internal/protocol"
+	"ephemeral/internal/room"
+	"ephemeral/internal/transport"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChunkSize is how much of a file each chunk frame carries.
+const ChunkSize = 64 << 10
+
+// Offers waiting for Accept or Reject are bounded, per peer and in all,
+// and expire after DefaultOfferTTL; offers beyond a bound are rejected.
+const (
+	MaxPendingOffers = 32
+	MaxOffersPerPeer = 8
+	DefaultOfferTTL  = 10 * time.Minute
+)
+
+type EventKind int
+
+const (
+	// Offered: a peer offers us a file, which waits for Accept or Reject.
+	Offered EventKind = iota
+	Progress
+	// Done: an incoming file was verified and saved at Path, or the
+	// recipient confirmed an outgoing one.
+	Done
+	Failed
+	// Rejected: the recipient declined an outgoing file or could not
+	// verify it.
+	Rejected
+)
+
+type Event struct {
+	Kind     EventKind
+	ID       string
+	Name     string
+	Nick     string
+	Incoming bool
+	Bytes    int64
+	Size     int64
+	Path     string
+	Err      error
+}
+
+// Status is a point-in-time view of a transfer in progress.
+type Status struct {
+	ID       string
+	Name     string
+	Nick     string
+	Incoming bool
+	Bytes    int64
+	Size     int64
+}
+
+type outgoing struct {
+	id, name, path, hash string
+	peer, nick, room     string
+	size, sent           int64
+	// gen is bumped by every accept; a stream stops once it is stale.
+	gen int
+}
+
+type incoming struct {
+	id, name, hash   string
+	peer, nick, room string
+	size, written    int64
+	// sealed offers only take sealed chunks.
+	sealed  bool
+	offered time.Time
+	dir     string
+	part    string
+	f       *os.File
+}
+
+// Manager moves files between directly connected peers as file envelopes
+// on the existing links. Frames for an encrypted room are sealed with the
+// room key, so only members can take part.
+type Manager struct {
+	tr    transport.Transport
+	rooms *room.Manager
+	// Dir is where accepted files are saved when Accept is given none.
+	Dir string
+	// OfferTTL is how long an offer waits to be answered.
+	OfferTTL time.Duration
+
+	mu       sync.Mutex
+	outgoing map[string]*outgoing
+	incoming map[string]*incoming
+	events   chan Event
+}
+
+func New(tr transport.Transport, rm *room.Manager) *Manager {
+	return &Manager{
+		tr:       tr,
+		rooms:    rm,
+		Dir:      ".",
+		OfferTTL: DefaultOfferTTL,
+		outgoing: make(map[string]*outgoing),
+		incoming: make(map[string]*incoming),
+		events:   make(chan Event, 64),
+	}
+}
+
+// Events reports offers and the progress and outcome of transfers. Events
+// that do not fit its buffer are dropped.
+func (m *Manager) Events() <-chan Event {
+	return m.events
+}
+
+// Offer offers the file at path to peerID from roomName and returns the
+// transfer ID. The file is hashed now; it is read again when the peer
+// accepts.
+func (m *Manager) Offer(peerID, nick, path, roomName string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !st.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	out := &outgoing{
+		id:   newID(),
+		name: filepath.Base(path),
+		path: path,
+		hash: hex.EncodeToString(h.Sum(nil)),
+		peer: peerID,
+		nick: nick,
+		room: roomName,
+		size: st.Size(),
+	}
+	m.mu.Lock()
+	m.outgoing[out.id] = out
+	m.mu.Unlock()
+
+	err = m.send(peerID, roomName, protocol.FileFrame{Op: protocol.FileOffer, ID: out.id, Name: out.name, Size: out.size, SHA256: out.hash})
+	if err != nil {
+		m.mu.Lock()
+		delete(m.outgoing, out.id)
+		m.mu.Unlock()
+		return "", err
+	}
+	return out.id, nil
+}
+
+// Accept starts receiving offer id into dir (Dir if empty). A partial copy
+// left in dir by an earlier attempt at the same file is resumed.
+func (m *Manager) Accept(id, dir string) error {
+	if dir == "" {
+		dir = m.Dir
+	}
+	m.expireOffers()
+	m.mu.Lock()
+	in, ok := m.incoming[id]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("no offer %s", id)
+	}
+	if in.f != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is already being received", in.name)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	part := filepath.Join(dir, "."+in.name+"."+in.hash[:12]+".part")
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		m.mu.Unlock()
+		return err
+	}
+	offset := st.Size()
+	if offset > in.size {
+		f.Truncate(0)
+		offset = 0
+	}
+	f.Seek(offset, io.SeekStart)
+	in.f, in.dir, in.part, in.written = f, dir, part, offset
+	m.mu.Unlock()
+
+	return m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileAccept, ID: id, Offset: offset})
+}
+
+// Reject declines offer id.
+func (m *Manager) Reject(id string) error {
+	m.mu.Lock()
+	in, ok := m.incoming[id]
+	if ok {
+		delete(m.incoming, id)
+		m.closePart(in, true)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no offer %s", id)
+	}
+	return m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileReject, ID: id})
+}
+
+// PeerUp resumes the transfers we were receiving from peerID when its link
+// dropped, by accepting them again from where they stopped.
+func (m *Manager) PeerUp(peerID string) {
+	m.mu.Lock()
+	var resume []protocol.FileFrame
+	var rooms []string
+	for _, in := range m.incoming {
+		if in.peer == peerID && in.f != nil {
+			resume = append(resume, protocol.FileFrame{Op: protocol.FileAccept, ID: in.id, Offset: in.written})
+			rooms = append(rooms, in.room)
+		}
+	}
+	m.mu.Unlock()
+	for i, f := range resume {
+		m.send(peerID, rooms[i], f)
+	}
+}
+
+// Active lists the transfers under way, by name.
+func (m *Manager) Active() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []Status
+	for _, out := range m.outgoing {
+		if out.gen > 0 {
+			list = append(list, Status{ID: out.id, Name: out.name, Nick: out.nick, Bytes: out.sent, Size: out.size})
+		}
+	}
+	for _, in := range m.incoming {
+		if in.f != nil {
+			list = append(list, Status{ID: in.id, Name: in.name, Nick: in.nick, Incoming: true, Bytes: in.written, Size: in.size})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Close abandons every transfer, keeping partial files for a later resume.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, in := range m.incoming {
+		m.closePart(in, false)
+	}
+}
+
+// Handle processes a file envelope that arrived from a peer.
+func (m *Manager) Handle(env protocol.Envelope) {
+	sealed := env.Enc
+	if sealed {
+		var err error
+		if env, err = m.rooms.Open(env); err != nil {
+			return
+		}
+	}
+	f, err := protocol.ParseFile(env)
+	if err != nil {
+		return
+	}
+	from := env.Via
+	if from == "" {
+		from = env.From
+	}
+
+	switch f.Op {
+	case protocol.FileOffer:
+		m.offered(env, from, sealed, f)
+	case protocol.FileAccept:
+		m.accepted(from, f)
+	case protocol.FileReject:
+		m.rejected(from, f)
+	case protocol.FileChunk:
+		m.chunk(from, sealed, f)
+	case protocol.FileDone:
+		m.done(from, f)
+	}
+}
+
+func (m *Manager) offered(env protocol.Envelope, from string, sealed bool, f protocol.FileFrame) {
+	name := filepath.Base(f.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || strings.ContainsAny(name, `/\`) ||
+		f.Size < 0 || f.ID == "" || !isHash(f.SHA256) {
+		return
+	}
+	in := &incoming{
+		id:      f.ID,
+		name:    name,
+		hash:    f.SHA256,
+		peer:    from,
+		nick:    env.Nick,
+		room:    env.Room,
+		size:    f.Size,
+		sealed:  sealed,
+		offered: time.Now(),
+	}
+	m.expireOffers()
+	m.mu.Lock()
+	if _, dup := m.incoming[f.ID]; dup {
+		m.mu.Unlock()
+		return
+	}
+	pending, fromPeer := 0, 0
+	for _, other := range m.incoming {
+		if other.f == nil {
+			pending++
+			if other.peer == from {
+				fromPeer++
+			}
+		}
+	}
+	if pending >= MaxPendingOffers || fromPeer >= MaxOffersPerPeer {
+		m.mu.Unlock()
+		m.send(from, in.room, protocol.FileFrame{Op: protocol.FileReject, ID: f.ID})
+		return
+	}
+	m.incoming[f.ID] = in
+	m.mu.Unlock()
+	m.emit(Event{Kind: Offered, ID: in.id, Name: name, Nick: in.nick, Incoming: true, Size: in.size})
+}
+
+func (m *Manager) accepted(from string, f protocol.FileFrame) {
+	m.mu.Lock()
+	out, ok := m.outgoing[f.ID]
+	if !ok || out.peer != from || f.Offset < 0 || f.Offset > out.size {
+		m.mu.Unlock()
+		return
+	}
+	out.gen++
+	out.sent = f.Offset
+	gen := out.gen
+	m.mu.Unlock()
+	go m.stream(out, gen, f.Offset)
+}
+
+// stream sends out from offset until it is done, superseded by a newer
+// accept, or the link drops. In the last case the recipient accepts again
+// once it is back.
+func (m *Manager) stream(out *outgoing, gen int, offset int64) {
+	file, err := os.Open(out.path)
+	if err != nil {
+		m.fail(out, err)
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, ChunkSize)
+	for offset < out.size {
+		m.mu.Lock()
+		stale := out.gen != gen || m.outgoing[out.id] != out
+		m.mu.Unlock()
+		if stale {
+			return
+		}
+		n, err := file.ReadAt(buf, offset)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = errors.New("file shrank while being sent")
+			}
+			m.fail(out, err)
+			return
+		}
+		if err := m.send(out.peer, out.room, protocol.FileFrame{Op: protocol.FileChunk, ID: out.id, Offset: offset, Data: buf[:n]}); err != nil {
+			return
+		}
+		m.mu.Lock()
+		out.sent = offset + int64(n)
+		m.mu.Unlock()
+		m.progress(offset, offset+int64(n), out.size, Event{ID: out.id, Name: out.name, Nick: out.nick})
+		offset += int64(n)
+	}
+	m.send(out.peer, out.room, protocol.FileFrame{Op: protocol.FileDone, ID: out.id})
+}
+
+func (m *Manager) rejected(from string, f protocol.FileFrame) {
+	m.mu.Lock()
+	out, ok := m.outgoing[f.ID]
+	if ok && out.peer == from {
+		delete(m.outgoing, f.ID)
+	}
+	m.mu.Unlock()
+	if ok && out.peer == from {
+		m.emit(Event{Kind: Rejected, ID: out.id, Name: out.name, Nick: out.nick, Size: out.size})
+	}
+}
+
+func (m *Manager) chunk(from string, sealed bool, f protocol.FileFrame) {
+	m.mu.Lock()
+	in, ok := m.incoming[f.ID]
+	// Chunks from a stream an accept has since replaced may still arrive;
+	// only the one that continues the file is taken.
+	if !ok || in.f == nil || in.peer != from || in.sealed != sealed ||
+		f.Offset != in.written || in.written+int64(len(f.Data)) > in.size {
+		m.mu.Unlock()
+		return
+	}
+	// The range is claimed before the write so the disk never holds the
+	// lock; chunks arrive one at a time from the peer's link.
+	file, before := in.f, in.written
+	in.written += int64(len(f.Data))
+	after, size := in.written, in.size
+	m.mu.Unlock()
+
+	if _, err := file.WriteAt(f.Data, before); err != nil {
+		// A Reject or Close that closed the file meanwhile already
+		// settled the transfer.
+		m.mu.Lock()
+		current := m.incoming[in.id] == in && in.f == file
+		if current {
+			delete(m.incoming, in.id)
+			m.closePart(in, false)
+		}
+		m.mu.Unlock()
+		if current {
+			m.emit(Event{Kind: Failed, ID: in.id, Name: in.name, Nick: in.nick, Incoming: true, Err: err})
+		}
+		return
+	}
+	m.progress(before, after, size, Event{ID: in.id, Name: in.name, Nick: in.nick, Incoming: true})
+}
+
+// expireOffers rejects offers that went unanswered for OfferTTL.
+func (m *Manager) expireOffers() {
+	cutoff := time.Now().Add(-m.OfferTTL)
+	var expired []*incoming
+	m.mu.Lock()
+	for id, in := range m.incoming {
+		if in.f == nil && in.offered.Before(cutoff) {
+			delete(m.incoming, id)
+			expired = append(expired, in)
+		}
+	}
+	m.mu.Unlock()
+	for _, in := range expired {
+		m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileReject, ID: in.id})
+	}
+}
+
+// done is the sender's end of stream when we are receiving, and the
+// recipient's confirmation when we are sending.
+func (m *Manager) done(from string, f protocol.FileFrame) {
+	m.mu.Lock()
+	if out, ok := m.outgoing[f.ID]; ok && out.peer == from {
+		delete(m.outgoing, f.ID)
+		m.mu.Unlock()
+		m.emit(Event{Kind: Done, ID: out.id, Name: out.name, Nick: out.nick, Bytes: out.size, Size: out.size})
+		return
+	}
+	in, ok := m.incoming[f.ID]
+	if !ok || in.f == nil || in.peer != from {
+		m.mu.Unlock()
+		return
+	}
+	if in.written != in.size {
+		// Part of the stream was lost to a reconnect; ask for the rest.
+		m.mu.Unlock()
+		m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileAccept, ID: in.id, Offset: in.written})
+		return
+	}
+	delete(m.incoming, in.id)
+	m.closePart(in, false)
+	m.mu.Unlock()
+
+	path, err := m.verify(in)
+	if err != nil {
+		os.Remove(in.part)
+		m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileReject, ID: in.id})
+		m.emit(Event{Kind: Failed, ID: in.id, Name: in.name, Nick: in.nick, Incoming: true, Err: err})
+		return
+	}
+	m.send(in.peer, in.room, protocol.FileFrame{Op: protocol.FileDone, ID: in.id})
+	m.emit(Event{Kind: Done, ID: in.id, Name: in.name, Nick: in.nick, Incoming: true, Bytes: in.size, Size: in.size, Path: path})
+}
+
+// verify checks the complete partial file against the offered hash and
+// moves it to its final name, never over an existing file.
+func (m *Manager) verify(in *incoming) (string, error) {
+	f, err := os.Open(in.part)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != in.hash {
+		return "", errors.New("SHA-256 mismatch")
+	}
+	path := freePath(in.dir, in.name)
+	return path, os.Rename(in.part, path)
+}
+
+// freePath returns dir/name, or "name (n)" with the first n not taken.
+func freePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext))
+	}
+}
+
+// closePart closes in's partial file, removing it if asked. Callers hold
+// m.mu.
+func (m *Manager) closePart(in *incoming, remove bool) {
+	if in.f == nil {
+		return
+	}
+	in.f.Close()
+	in.f = nil
+	if remove {
+		os.Remove(in.part)
+	}
+}
+
+func (m *Manager) fail(out *outgoing, err error) {
+	m.mu.Lock()
+	delete(m.outgoing, out.id)
+	m.mu.Unlock()
+	m.emit(Event{Kind: Failed, ID: out.id, Name: out.name, Nick: out.nick, Err: err})
+}
+
+// progress reports a transfer moving from before to after bytes, in
+// whole-percent steps.
+func (m *Manager) progress(before, after, size int64, ev Event) {
+	if size > 0 && before*100/size == after*100/size {
+		return
+	}
+	ev.Kind, ev.Bytes, ev.Size = Progress, after, size
+	m.emit(ev)
+}
+
+func (m *Manager) send(peerID, roomName string, f protocol.FileFrame) error {
+	return sendFrame(m.tr, m.rooms, peerID, roomName, f)
+}
+
+// sendFrame sends f to peerID, sealed with the key of roomName if it is
+// encrypted.
+func sendFrame(tr transport.Transport, rooms *room.Manager, peerID, roomName string, f protocol.FileFrame) error {
+	env := protocol.NewFile(fmt.Sprintf("%s-%d", rooms.PeerID, time.Now().UnixNano()), rooms.PeerID, rooms.Nick(), roomName, f)
+	env, err := rooms.Seal(env)
+	if err != nil {
+		return err
+	}
+	return tr.Send(peerID, env)
+}
+
+// Decline rejects a file offer on behalf of a node that has no Manager,
+// because nobody is there to accept it, so the sender does not wait for an
+// answer. Other frames are ignored.
+func Decline(tr transport.Transport, rooms *room.Manager, env protocol.Envelope) {
+	if env.Enc {
+		var err error
+		if env, err = rooms.Open(env); err != nil {
+			return
+		}
+	}
+	f, err := protocol.ParseFile(env)
+	if err != nil || f.Op != protocol.FileOffer || f.ID == "" {
+		return
+	}
+	from := env.Via
+	if from == "" {
+		from = env.From
+	}
+	sendFrame(tr, rooms, from, env.Room, protocol.FileFrame{Op: protocol.FileReject, ID: f.ID})
+}
+
+// emit publishes ev without blocking the caller, which may be the very
+// loop that drains Events. Events are dropped while the buffer is full, so
+// a front end that stops reading costs nothing but what it misses.
+func (m *Manager) emit(ev Event) {
+	select {
+	case m.events <- ev:
+	default:
+	}
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHash(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
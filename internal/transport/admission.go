@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrOutboundLimit is returned by Dial when MaxOutbound links are open.
+var ErrOutboundLimit = errors.New("outbound connection limit reached")
+
+// AdmissionStats counts the connections a Mesh holds and those it turned
+// away.
+type AdmissionStats struct {
+	Inbound  int
+	Outbound int
+
+	// RejectedInbound and RejectedPerIP count accepted connections closed
+	// at once for exceeding MaxInbound or MaxPerIP; RejectedOutbound counts
+	// dials refused at MaxOutbound; HandshakeTimeouts counts inbound
+	// connections that sent no hello within HandshakeTimeout.
+	RejectedInbound   uint64
+	RejectedPerIP     uint64
+	RejectedOutbound  uint64
+	HandshakeTimeouts uint64
+}
+
+// admission tracks open connections against the Mesh's limits. Slots are
+// held from accept (or dial) until the connection's read loop ends, so
+// half-open handshakes count too.
+type admission struct {
+	mu       sync.Mutex
+	inbound  int
+	outbound int
+	perIP    map[string]int
+
+	rejectedInbound   atomic.Uint64
+	rejectedPerIP     atomic.Uint64
+	rejectedOutbound  atomic.Uint64
+	handshakeTimeouts atomic.Uint64
+}
+
+func newAdmission() *admission {
+	return &admission{perIP: make(map[string]int)}
+}
+
+// admit reserves an inbound slot for conn, reporting false if a limit is
+// reached. A limit of zero is no limit.
+func (t *Mesh) admit(conn net.Conn) bool {
+	a := t.admission
+	ip := remoteIP(conn)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case t.MaxInbound > 0 && a.inbound >= t.MaxInbound:
+		a.rejectedInbound.Add(1)
+		return false
+	case ip != "" && t.MaxPerIP > 0 && a.perIP[ip] >= t.MaxPerIP:
+		a.rejectedPerIP.Add(1)
+		return false
+	}
+	a.inbound++
+	if ip != "" {
+		a.perIP[ip]++
+	}
+	return true
+}
+
+// reserveOutbound reserves a slot for a dial.
+func (t *Mesh) reserveOutbound() error {
+	a := t.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t.MaxOutbound > 0 && a.outbound >= t.MaxOutbound {
+		a.rejectedOutbound.Add(1)
+		return ErrOutboundLimit
+	}
+	a.outbound++
+	return nil
+}
+
+// release frees the slot conn held.
+func (t *Mesh) release(conn net.Conn, inbound bool) {
+	a := t.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !inbound {
+		a.outbound--
+		return
+	}
+	a.inbound--
+	if ip := remoteIP(conn); ip != "" {
+		if a.perIP[ip]--; a.perIP[ip] <= 0 {
+			delete(a.perIP, ip)
+		}
+	}
+}
+
+// Admission reports current connection counts and rejections so far.
+func (t *Mesh) Admission() AdmissionStats {
+	a := t.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AdmissionStats{
+		Inbound:           a.inbound,
+		Outbound:          a.outbound,
+		RejectedInbound:   a.rejectedInbound.Load(),
+		RejectedPerIP:     a.rejectedPerIP.Load(),
+		RejectedOutbound:  a.rejectedOutbound.Load(),
+		HandshakeTimeouts: a.handshakeTimeouts.Load(),
+	}
+}
+
+// remoteIP is the per-IP key for conn, or "" for connections that are not
+// capped: loopback (several local instances are normal) and non-IP links.
+func remoteIP(conn net.Conn) string {
+	a, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || a.IP.IsLoopback() {
+		return ""
+	}
+	return a.IP.String()
+}
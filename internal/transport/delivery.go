@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"ephemeral/internal/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	ackDelay    = 100 * time.Millisecond
+	maxAckBatch = 64
+	maxTracked  = 1000
+)
+
+// DeliveryStatus counts the peers that have and have not yet acknowledged
+// one of our chat messages. Acks are hop by hop: they come from the
+// neighbours we handed the message to, so behind a relay or over the
+// gossip overlay they do not prove the message reached every reader.
+type DeliveryStatus struct {
+	Acked   int
+	Pending int
+}
+
+// AckEvent is emitted when a peer acknowledges one of our chat messages.
+type AckEvent struct {
+	ID   string
+	Peer string
+}
+
+type delivery struct {
+	env     protocol.Envelope
+	pending map[string]bool
+	acked   map[string]bool
+}
+
+// deliveryTracker remembers our most recent chat messages and which peers
+// still owe an ack for each, so they can be retransmitted on reconnect.
+type deliveryTracker struct {
+	mu    sync.Mutex
+	msgs  map[string]*delivery
+	order []string
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{msgs: make(map[string]*delivery)}
+}
+
+func (d *deliveryTracker) track(env protocol.Envelope, peers []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Messages sent peer by peer are tracked once and accumulate peers.
+	if dl, exists := d.msgs[env.ID]; exists {
+		for _, p := range peers {
+			if !dl.acked[p] {
+				dl.pending[p] = true
+			}
+		}
+		return
+	}
+	dl := &delivery{
+		env:     env,
+		pending: make(map[string]bool, len(peers)),
+		acked:   make(map[string]bool),
+	}
+	for _, p := range peers {
+		dl.pending[p] = true
+	}
+	d.msgs[env.ID] = dl
+	d.order = append(d.order, env.ID)
+	if len(d.order) > maxTracked {
+		for _, id := range d.order[:len(d.order)-maxTracked] {
+			delete(d.msgs, id)
+		}
+		d.order = d.order[len(d.order)-maxTracked:]
+	}
+}
+
+// ack records that peer received ids and returns the ones that were still
+// pending for it.
+func (d *deliveryTracker) ack(peer string, ids []string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var fresh []string
+	for _, id := range ids {
+		dl, ok := d.msgs[id]
+		if !ok || dl.acked[peer] {
+			continue
+		}
+		delete(dl.pending, peer)
+		dl.acked[peer] = true
+		fresh = append(fresh, id)
+	}
+	return fresh
+}
+
+// unacked returns the messages peer has not acknowledged, oldest first.
+func (d *deliveryTracker) unacked(peer string) []protocol.Envelope {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var envs []protocol.Envelope
+	for _, id := range d.order {
+		if dl := d.msgs[id]; dl.pending[peer] {
+			envs = append(envs, dl.env)
+		}
+	}
+	return envs
+}
+
+func (d *deliveryTracker) status(id string) (DeliveryStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dl, ok := d.msgs[id]
+	if !ok {
+		return DeliveryStatus{}, false
+	}
+	return DeliveryStatus{Acked: len(dl.acked), Pending: len(dl.pending)}, true
+}
+
+// queueAck schedules an ack for id; acks are batched per peer and flushed
+// after ackDelay or once maxAckBatch IDs are waiting.
+func (p *PeerConn) queueAck(t *Mesh, id string) {
+	p.ackMu.Lock()
+	p.acks = append(p.acks, id)
+	n := len(p.acks)
+	if n == 1 {
+		p.ackTimer = time.AfterFunc(ackDelay, func() { p.flushAcks(t) })
+	}
+	p.ackMu.Unlock()
+
+	if n >= maxAckBatch {
+		p.flushAcks(t)
+	}
+}
+
+func (p *PeerConn) flushAcks(t *Mesh) {
+	p.ackMu.Lock()
+	ids := p.acks
+	p.acks = nil
+	if p.ackTimer != nil {
+		p.ackTimer.Stop()
+		p.ackTimer = nil
+	}
+	p.ackMu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+	p.send(protocol.NewAck(t.nextID(), t.ID, t.Nick, ids))
+}
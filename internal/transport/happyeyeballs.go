@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// attemptDelay is how long a connection attempt gets before the next address
+// is tried in parallel (RFC 8305 "Connection Attempt Delay").
+const attemptDelay = 250 * time.Millisecond
+
+// dialAny connects to whichever of addrs answers first. Attempts are
+// staggered by attemptDelay, or started early when the previous one fails,
+// and the losers are closed once a winner is found.
+func (t *Mesh) dialAny(ctx context.Context, addrs []string) (net.Conn, string, error) {
+	addrs = interleave(addrs)
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no address to dial")
+	}
+	if len(addrs) == 1 {
+		conn, err := t.link.Dial(ctx, addrs[0])
+		return conn, addrs[0], err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := t.link.Dial(ctx, addr)
+			results <- result{conn, addr, err}
+		}()
+		timer.Reset(attemptDelay)
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if lost := <-results; lost.conn != nil {
+							lost.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.addr, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, "", firstErr
+}
+
+// interleave drops duplicate addresses and orders IP literals alternately
+// IPv6 then IPv4, as RFC 8305 recommends, so a broken family costs at most
+// one attempt delay. Non-IP addresses (host names, socket paths) keep their
+// order and come last.
+func interleave(addrs []string) []string {
+	var v6, v4, other []string
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		host, _, err := net.SplitHostPort(addr)
+		ip, perr := netip.ParseAddr(host)
+		switch {
+		case err != nil || perr != nil:
+			other = append(other, addr)
+		case ip.Is4() || ip.Is4In6():
+			v4 = append(v4, addr)
+		default:
+			v6 = append(v6, addr)
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return append(out, other...)
+}
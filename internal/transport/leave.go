@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"ephemeral/internal/protocol"
+	"sync"
+	"time"
+)
+
+// leaveTimeout bounds how long Stop waits on a peer to take our leave.
+const leaveTimeout = time.Second
+
+// newLeaveToken returns the secret a mesh reveals when it leaves. Its hash
+// goes out in every hello, so a leave can only come from whoever sent the
+// hello, not from another peer on the path.
+func newLeaveToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func leaveHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sayGoodbye sends a signed leave to every connected peer, waiting at most
+// leaveTimeout for all of them together.
+func (t *Mesh) sayGoodbye() {
+	t.peersLock.RLock()
+	peers := make([]*PeerConn, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.peersLock.RUnlock()
+
+	leave := t.control(protocol.Control{Op: protocol.ControlLeave})
+	leave.Sig = t.leaveToken
+	deadline := time.Now().Add(leaveTimeout)
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.wmu.Lock()
+			defer p.wmu.Unlock()
+			p.Conn.SetWriteDeadline(deadline)
+			p.Enc.Encode(leave)
+		}()
+	}
+	wg.Wait()
+}
+
+// acceptLeave checks a leave's signature against the hash p sent in its
+// hello and, if it matches, marks p as gone for good. Peers that sent no
+// hash cannot leave; they simply drop.
+func (p *PeerConn) acceptLeave(env protocol.Envelope) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaveHash == "" || subtle.ConstantTimeCompare([]byte(leaveHash(env.Sig)), []byte(p.leaveHash)) != 1 {
+		return false
+	}
+	p.left = true
+	return true
+}
+
+func (p *PeerConn) hasLeft() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MemoryNetwork is an in-process network of named endpoints connected by
+// net.Pipe. It makes multi-peer tests deterministic and port-free.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*memListener)}
+}
+
+// NewMemory returns a Mesh reachable at addr on network n.
+func NewMemory(n *MemoryNetwork, addr, id, nick string) *Mesh {
+	return NewMesh(&memLink{net: n, addr: addr}, id, nick)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
+
+type memLink struct {
+	net  *MemoryNetwork
+	addr string
+}
+
+func (l *memLink) Listen() (net.Listener, error) {
+	l.net.mu.Lock()
+	defer l.net.mu.Unlock()
+	if _, exists := l.net.listeners[l.addr]; exists {
+		return nil, fmt.Errorf("memory address %s already in use", l.addr)
+	}
+	ln := &memListener{
+		net:    l.net,
+		addr:   memAddr(l.addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	l.net.listeners[l.addr] = ln
+	return ln, nil
+}
+
+func (l *memLink) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	l.net.mu.Lock()
+	ln, ok := l.net.listeners[addr]
+	l.net.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memAddr(addr), Err: fmt.Errorf("connection refused")}
+	}
+
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- &memConn{Conn: server, local: ln.addr, remote: memAddr(l.addr)}:
+		return &memConn{Conn: client, local: memAddr(l.addr), remote: ln.addr}, nil
+	case <-ln.closed:
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: ln.addr, Err: fmt.Errorf("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memListener struct {
+	net       *MemoryNetwork
+	addr      memAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.net.mu.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memConn struct {
+	net.Conn
+	local, remote memAddr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"ephemeral/internal/protocol"
+	"sort"
+)
+
+// Subscribe tells every peer we want traffic for room.
+func (t *Mesh) Subscribe(room string) {
+	t.roomsLock.Lock()
+	if t.rooms[room] {
+		t.roomsLock.Unlock()
+		return
+	}
+	t.rooms[room] = true
+	t.roomsLock.Unlock()
+
+	t.broadcastControl(protocol.Control{Op: protocol.ControlSubscribe, Rooms: []string{room}})
+}
+
+// Unsubscribe tells every peer to stop sending us traffic for room.
+func (t *Mesh) Unsubscribe(room string) {
+	t.roomsLock.Lock()
+	if !t.rooms[room] {
+		t.roomsLock.Unlock()
+		return
+	}
+	delete(t.rooms, room)
+	t.roomsLock.Unlock()
+
+	t.broadcastControl(protocol.Control{Op: protocol.ControlUnsubscribe, Rooms: []string{room}})
+}
+
+func (t *Mesh) subscriptions() []string {
+	t.roomsLock.Lock()
+	defer t.roomsLock.Unlock()
+	rooms := make([]string, 0, len(t.rooms))
+	for r := range t.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (t *Mesh) broadcastControl(c protocol.Control) {
+	t.peersLock.RLock()
+	defer t.peersLock.RUnlock()
+	for _, p := range t.peers {
+		go p.send(t.control(c))
+	}
+}
+
+// setRooms records the rooms p announced in its hello. A peer that sent an
+// empty hello predates subscriptions and gets everything.
+func (p *PeerConn) setRooms(env protocol.Envelope) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := protocol.ParseHello(env)
+	if !ok {
+		p.rooms = nil
+		return
+	}
+	p.rooms = make(map[string]bool, len(h.Rooms))
+	for _, r := range h.Rooms {
+		p.rooms[r] = true
+	}
+}
+
+func (p *PeerConn) subscribe(rooms []string, on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rooms == nil {
+		p.rooms = make(map[string]bool)
+	}
+	for _, r := range rooms {
+		if on {
+			p.rooms[r] = true
+		} else {
+			delete(p.rooms, r)
+		}
+	}
+}
+
+// wants reports whether env should be sent to p. Only chat is routed by
+// room; everything else goes to every peer.
+func (p *PeerConn) wants(env protocol.Envelope) bool {
+	if env.Type != protocol.TypeChat || env.Room == "" {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rooms == nil || p.rooms[protocol.AllRooms] || p.rooms[env.Room]
+}
+
+func (p *PeerConn) roomList() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rooms == nil {
+		return []string{protocol.AllRooms}
+	}
+	rooms := make([]string, 0, len(p.rooms))
+	for r := range p.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
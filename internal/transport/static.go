@@ -0,0 +1,74 @@
+package transport
+
+import "time"
+
+// staticCheck is how often a connected static peer is checked on.
+const staticCheck = 2 * time.Second
+
+// Persist adds addr as a static peer, for networks where discovery cannot
+// see it. Unlike redial, which gives up after maxRedials, the link is
+// restored for as long as the mesh runs, whichever side it was lost from.
+func (t *Mesh) Persist(addr string) {
+	t.staticLock.Lock()
+	defer t.staticLock.Unlock()
+	if _, ok := t.static[addr]; ok {
+		return
+	}
+	t.static[addr] = ""
+	go t.keep(addr)
+}
+
+func (t *Mesh) keep(addr string) {
+	backoff := time.Second
+	var wait time.Duration
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		t.staticLock.Lock()
+		id := t.static[addr]
+		t.staticLock.Unlock()
+		if id != "" && t.peer(id) != nil {
+			wait, backoff = staticCheck, time.Second
+			continue
+		}
+
+		// The peer is dialled by address alone: a restarted instance comes
+		// back under a new ID and should still be reached.
+		if _, err := t.dial("", []string{addr}); err != nil {
+			wait = backoff
+			backoff *= 2
+			if backoff > maxRedialBackoff {
+				backoff = maxRedialBackoff
+			}
+			continue
+		}
+		wait, backoff = staticCheck, time.Second
+	}
+}
+
+// markStatic records that addr reached peerID and reports whether addr is
+// a static peer.
+func (t *Mesh) markStatic(addr, peerID string) bool {
+	t.staticLock.Lock()
+	defer t.staticLock.Unlock()
+	if _, ok := t.static[addr]; !ok {
+		return false
+	}
+	t.static[addr] = peerID
+	return true
+}
+
+func (t *Mesh) isStatic(peerID string) bool {
+	t.staticLock.Lock()
+	defer t.staticLock.Unlock()
+	for _, id := range t.static {
+		if id == peerID {
+			return true
+		}
+	}
+	return false
+}
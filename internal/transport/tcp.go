@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+type tcpLink struct {
+	addrs []string
+}
+
+// NewTCP returns a Mesh listening on port on every interface. Port 0 picks
+// a random free port; read it back from Addr after Start.
+func NewTCP(port int, id, nick string) *Mesh {
+	return NewTCPOn([]string{fmt.Sprintf(":%d", port)}, id, nick)
+}
+
+// NewTCPOn returns a Mesh listening on each of addrs, which must all use the
+// same port. If that port is 0, the one picked for the first address is
+// reused for the rest.
+func NewTCPOn(addrs []string, id, nick string) *Mesh {
+	return NewMesh(&tcpLink{addrs: addrs}, id, nick)
+}
+
+func (l *tcpLink) Listen() (net.Listener, error) {
+	if len(l.addrs) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+	first, err := net.Listen("tcp", l.addrs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(l.addrs) == 1 {
+		return first, nil
+	}
+
+	port := strconv.Itoa(first.Addr().(*net.TCPAddr).Port)
+	lns := []net.Listener{first}
+	for _, addr := range l.addrs[1:] {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			var ln net.Listener
+			if ln, err = net.Listen("tcp", net.JoinHostPort(host, port)); err == nil {
+				lns = append(lns, ln)
+				continue
+			}
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return newMultiListener(lns), nil
+}
+
+func (l *tcpLink) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Port returns the TCP port t is listening on, or 0 if t is not a started
+// TCP transport.
+func Port(t Transport) int {
+	if a, ok := t.Addr().(*net.TCPAddr); ok {
+		return a.Port
+	}
+	return 0
+}
+
+// multiListener accepts from several listeners at once, so one Mesh can be
+// bound to a chosen set of addresses. Addr reports the first of them.
+type multiListener struct {
+	lns       []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	m := &multiListener{lns: lns, conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, ln := range lns {
+		go m.accept(ln)
+	}
+	return m
+}
+
+func (m *multiListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.lns {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.lns[0].Addr()
+}
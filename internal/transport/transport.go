@@ -2,25 +2,153 @@ package transport
 
 import (
 	"context"
-	"encoding/json"
 	"ephemeral/internal/protocol"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"slices"
 	"sync"
 	"time"
 )
 
-type Transport struct {
-	Port       int
-	ID         string
-	Nick       string
-	
-	listener   net.Listener
-	peers      map[string]*PeerConn
-	peersLock  sync.RWMutex
-	
+const (
+	DefaultHeartbeat   = 5 * time.Second
+	DefaultIdleTimeout = 20 * time.Second
+
+	// Admission defaults: enough for a busy full mesh, small enough that
+	// one host cannot exhaust descriptors.
+	DefaultMaxInbound       = 128
+	DefaultMaxOutbound      = 128
+	DefaultMaxPerIP         = 16
+	DefaultHandshakeTimeout = 5 * time.Second
+
+	writeTimeout     = 5 * time.Second
+	dialTimeout      = 5 * time.Second
+	maxRedials       = 8
+	maxRedialBackoff = 30 * time.Second
+)
+
+// Transport moves envelopes between this node and its directly connected
+// peers. Implementations differ only in the network they run over.
+type Transport interface {
+	Start() error
+	// Dial connects to the first of addrs that answers. peerID may be empty
+	// when the remote identity is not known yet; it is learned from the
+	// handshake.
+	Dial(peerID string, addrs ...string) error
+	Send(peerID string, env protocol.Envelope) error
+	Broadcast(env protocol.Envelope)
+	// Disconnect closes the link to peerID without trying to restore it.
+	Disconnect(peerID string)
+	// Persist makes addr a static peer: it is dialled now and redialled
+	// whenever no link to it is up, for as long as the transport runs.
+	Persist(addr string)
+	// Subscribe and Unsubscribe announce which rooms we want chat traffic
+	// for; Broadcast only sends a room's chat to peers subscribed to it.
+	Subscribe(room string)
+	Unsubscribe(room string)
+	Incoming() <-chan protocol.Envelope
+	Events() <-chan PeerEvent
+	Stop()
+
+	Addr() net.Addr
+	Peers() []PeerInfo
+	Ping(peerID string) error
+	Delivery(id string) (DeliveryStatus, bool)
+	Acks() <-chan AckEvent
+}
+
+// Link is the network a Mesh runs over.
+type Link interface {
+	Listen() (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+type PeerEventType int
+
+const (
+	PeerUp PeerEventType = iota
+	PeerDown
+)
+
+type PeerEvent struct {
+	Type PeerEventType
+	ID   string
+	Nick string
+	Addr string
+	// Static is set on PeerUp for peers added with Persist.
+	Static bool
+	// Left is set on PeerDown when the peer announced its departure, and
+	// Rooms then lists the rooms it was subscribed to.
+	Left  bool
+	Rooms []string
+	// Clock is the peer's Lamport clock from its hello, on PeerUp.
+	Clock uint64
+}
+
+// Mesh is a Transport that keeps one long-lived stream connection per peer
+// over a Link. The TCP, Unix-socket and in-memory transports are all Meshes.
+type Mesh struct {
+	ID   string
+	Nick string
+
+	// Heartbeat is how often each peer is pinged; IdleTimeout is how long a
+	// peer may stay silent before its connection is torn down.
+	Heartbeat   time.Duration
+	IdleTimeout time.Duration
+
+	// Codecs are the wire codecs offered when dialling, most preferred
+	// first. Inbound links use whichever the dialer prefers.
+	Codecs []string
+
+	// MaxInbound and MaxOutbound cap open connections in each direction
+	// and MaxPerIP caps inbound ones from any single non-loopback address;
+	// zero means unlimited. An inbound connection that has not sent its
+	// hello within HandshakeTimeout is closed.
+	MaxInbound       int
+	MaxOutbound      int
+	MaxPerIP         int
+	HandshakeTimeout time.Duration
+
+	// Compress accepts and sends DEFLATE-compressed payloads, for peers
+	// that do the same, once they reach CompressMin bytes.
+	Compress    bool
+	CompressMin int
+
+	// Clock, if set, reports our Lamport clock for the hello, so a peer
+	// that just started moves its clock past the history it joins.
+	Clock func() uint64
+
+	// Quiet drops the link without announcing a leave, for short sessions
+	// such as one-shot commands whose departure is not news to anyone.
+	// Peers see such a mesh disconnect but never that it left.
+	Quiet bool
+
+	link      Link
+	listener  net.Listener
+	peers     map[string]*PeerConn
+	peersLock sync.RWMutex
+
+	// addrs remembers where outbound peers were dialled so dropped links
+	// can be re-established.
+	addrs     map[string][]string
+	addrsLock sync.Mutex
+
+	// static maps each Persist address to the peer last reached there.
+	static     map[string]string
+	staticLock sync.Mutex
+
+	rooms     map[string]bool
+	roomsLock sync.Mutex
+
+	leaveToken string
+	admission  *admission
+	deliveries *deliveryTracker
 	incomingCh chan protocol.Envelope
+	eventCh    chan PeerEvent
+	ackCh      chan AckEvent
 	ctx        context.Context
 	cancel     context.CancelFunc
 }
@@ -28,42 +156,95 @@ type Transport struct {
 type PeerConn struct {
 	ID   string
 	Conn net.Conn
-	Enc  *json.Encoder
-	Dec  *json.Decoder
+	Enc  protocol.Encoder
+	Dec  protocol.Decoder
+	// Codec is the name of the codec negotiated for the link.
+	Codec string
+	// zipMin is the payload size from which envelopes to this peer are
+	// compressed, or 0 if the link does not compress.
+	zipMin int
+	// leaveHash is the commitment from the peer's hello; left is set once
+	// a leave matching it arrives.
+	leaveHash string
+	left      bool
+
+	wmu      sync.Mutex
+	mu       sync.Mutex
+	nick     string
+	lastSeen time.Time
+	rtt      time.Duration
+	rooms    map[string]bool
+
+	ackMu    sync.Mutex
+	acks     []string
+	ackTimer *time.Timer
 }
 
-func New(port int, id, nick string) *Transport {
+// PeerInfo is a point-in-time snapshot of a connected peer.
+type PeerInfo struct {
+	ID       string
+	Nick     string
+	Addr     string
+	RTT      time.Duration
+	LastSeen time.Time
+	Rooms    []string
+	Codec    string
+	Compress bool
+}
+
+var _ Transport = (*Mesh)(nil)
+
+func NewMesh(link Link, id, nick string) *Mesh {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Transport{
-		Port:       port,
-		ID:         id,
-		Nick:       nick,
-		peers:      make(map[string]*PeerConn),
-		incomingCh: make(chan protocol.Envelope, 100),
-		ctx:        ctx,
-		cancel:     cancel,
+	return &Mesh{
+		ID:               id,
+		Nick:             nick,
+		Heartbeat:        DefaultHeartbeat,
+		IdleTimeout:      DefaultIdleTimeout,
+		Codecs:           []string{protocol.CodecJSON},
+		MaxInbound:       DefaultMaxInbound,
+		MaxOutbound:      DefaultMaxOutbound,
+		MaxPerIP:         DefaultMaxPerIP,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Compress:         true,
+		CompressMin:      protocol.DefaultCompressMin,
+		link:             link,
+		peers:            make(map[string]*PeerConn),
+		addrs:            make(map[string][]string),
+		static:           make(map[string]string),
+		rooms:            map[string]bool{"global": true},
+		leaveToken:       newLeaveToken(),
+		admission:        newAdmission(),
+		deliveries:       newDeliveryTracker(),
+		incomingCh:       make(chan protocol.Envelope, 100),
+		eventCh:          make(chan PeerEvent, 100),
+		ackCh:            make(chan AckEvent, 100),
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
-func (t *Transport) Start() error {
-	addr := fmt.Sprintf(":%d", t.Port)
-	ln, err := net.Listen("tcp", addr)
+func (t *Mesh) Start() error {
+	ln, err := t.link.Listen()
 	if err != nil {
 		return err
 	}
 	t.listener = ln
-	
-	if t.Port == 0 {
-		if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
-			t.Port = tcpAddr.Port
-		}
-	}
-	
+
 	go t.acceptLoop()
+	go t.heartbeatLoop()
 	return nil
 }
 
-func (t *Transport) acceptLoop() {
+// Addr is the address the mesh is listening on.
+func (t *Mesh) Addr() net.Addr {
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+func (t *Mesh) acceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
@@ -71,105 +252,544 @@ func (t *Transport) acceptLoop() {
 			case <-t.ctx.Done():
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Warn("Accept failed", "err", err)
 				continue
 			}
 		}
+		if !t.admit(conn) {
+			conn.Close()
+			continue
+		}
 		go t.handleConn(conn, nil, "")
 	}
 }
 
-func (t *Transport) handleConn(conn net.Conn, dec *json.Decoder, knownPeerID string) {
+// handleConn runs a connection's read loop. An inbound connection (no
+// knownPeerID) starts with the dialer's hello, which must arrive within
+// HandshakeTimeout.
+func (t *Mesh) handleConn(conn net.Conn, dec protocol.Decoder, knownPeerID string) {
+	defer t.release(conn, knownPeerID == "")
 	if dec == nil {
-		dec = json.NewDecoder(conn)
+		dec = protocol.JSON.NewDecoder(conn)
+	}
+	if knownPeerID == "" && t.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.HandshakeTimeout))
 	}
 
 	peerID := knownPeerID
+	var peer *PeerConn
+	if peerID != "" {
+		peer = t.peer(peerID)
+	}
 
 	for {
 		var env protocol.Envelope
 		if err := dec.Decode(&env); err != nil {
+			if peerID == "" && errors.Is(err, os.ErrDeadlineExceeded) {
+				t.admission.handshakeTimeouts.Add(1)
+			}
 			conn.Close()
 			if peerID != "" {
-				t.removePeer(peerID)
+				t.removePeer(peerID, conn)
+			}
+			if knownPeerID != "" && t.ctx.Err() == nil && (peer == nil || !peer.hasLeft()) {
+				go t.redial(knownPeerID)
 			}
 			return
 		}
-		
+
+		// The first envelope on an inbound connection is the dialer's hello;
+		// answer it with our own so both sides learn each other's nick, and
+		// switch to the codec the dialer prefers. The reply goes out before
+		// the peer is visible to Broadcast, so it is always the first line.
 		if peerID == "" {
+			if env.From == "" || env.From == t.ID {
+				conn.Close()
+				return
+			}
+			h, _ := protocol.ParseHello(env)
+			codec := protocol.ChooseCodec(h.Codecs)
+			reply := t.hello("")
+			if len(h.Codecs) > 0 {
+				reply = t.hello(codec.Name())
+			}
+			conn.SetReadDeadline(time.Time{})
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := protocol.JSON.NewEncoder(conn).Encode(reply); err != nil {
+				conn.Close()
+				return
+			}
+			if codec != protocol.JSON {
+				dec = protocol.Switch(codec, dec, conn)
+			}
+
 			peerID = env.From
-			enc := json.NewEncoder(conn)
-			t.addPeer(peerID, conn, enc, dec)
+			resend := t.deliveries.unacked(peerID)
+			peer = t.addPeer(peerID, conn, codec, dec, h)
+			peer.touch(env.Nick)
+			peer.setRooms(env)
+			t.emit(PeerEvent{Type: PeerUp, ID: peerID, Nick: env.Nick, Addr: conn.RemoteAddr().String(), Static: t.isStatic(peerID), Clock: h.Clock})
+			go t.retransmit(peer, resend)
+			continue
 		}
-		
+
+		if peer != nil {
+			if env.From == peerID {
+				peer.touch(env.Nick)
+			} else {
+				peer.touch("")
+			}
+		}
+
+		if env.Type == protocol.TypePresence && env.ID == "" {
+			continue
+		}
+		if env.Zip {
+			var err error
+			if env, err = protocol.Inflate(env); err != nil {
+				slog.Warn("Dropping undecodable message", "id", env.ID, "peer", peerID, "err", err)
+				continue
+			}
+		}
+		if env.Type == protocol.TypeControl && peer != nil && t.handleControl(peer, env) {
+			continue
+		}
+		if env.Type == protocol.TypeAck {
+			t.handleAck(peer, env)
+			continue
+		}
+		if env.Type == protocol.TypeChat && peer != nil {
+			peer.queueAck(t, env.ID)
+		}
+
+		env.Via = peerID
 		t.incomingCh <- env
 	}
 }
 
-func (t *Transport) Connect(peerID, ip string, port int) error {
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// handleControl consumes link-level control envelopes and reports whether
+// the envelope was handled here.
+func (t *Mesh) handleControl(p *PeerConn, env protocol.Envelope) bool {
+	c, err := protocol.ParseControl(env)
 	if err != nil {
-		return err
+		return false
+	}
+	switch c.Op {
+	case protocol.ControlPing:
+		go p.send(t.control(protocol.Control{Op: protocol.ControlPong, Sent: c.Sent}))
+		return true
+	case protocol.ControlPong:
+		if c.Sent > 0 {
+			p.mu.Lock()
+			p.rtt = time.Since(time.Unix(0, c.Sent))
+			p.mu.Unlock()
+		}
+		return true
+	case protocol.ControlSubscribe, protocol.ControlUnsubscribe:
+		p.subscribe(c.Rooms, c.Op == protocol.ControlSubscribe)
+		return true
+	case protocol.ControlLeave:
+		if p.acceptLeave(env) {
+			p.Conn.Close()
+		}
+		return true
+	}
+	return false
+}
+
+func (t *Mesh) handleAck(p *PeerConn, env protocol.Envelope) {
+	a, err := protocol.ParseAck(env)
+	if err != nil || p == nil {
+		return
+	}
+	for _, id := range t.deliveries.ack(p.ID, a.IDs) {
+		select {
+		case t.ackCh <- AckEvent{ID: id, Peer: p.ID}:
+		default:
+		}
+	}
+}
+
+// retransmit resends the chat messages p had not acknowledged when its link
+// was (re)established. The list is taken before p becomes visible to
+// Broadcast so newer messages are not sent twice.
+func (t *Mesh) retransmit(p *PeerConn, envs []protocol.Envelope) {
+	for _, env := range envs {
+		if err := p.send(env); err != nil {
+			return
+		}
 	}
-	
-	hello := protocol.NewEnvelope(
-		fmt.Sprintf("%s-%d", t.ID, time.Now().UnixNano()),
-		t.ID,
-		t.Nick,
-		"global",
-		protocol.TypePresence,
-		"",
-	)
-	
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(conn)
-	
-	t.addPeer(peerID, conn, enc, dec)
-	
-	if err := enc.Encode(hello); err != nil {
+}
+
+// Dial races addrs happy-eyeballs style and completes the hello exchange on
+// the winning connection before returning, so the peer can be addressed as
+// soon as Dial succeeds.
+func (t *Mesh) Dial(peerID string, addrs ...string) error {
+	_, err := t.dial(peerID, addrs)
+	return err
+}
+
+// dial is Dial returning the identity of the peer it reached.
+func (t *Mesh) dial(peerID string, addrs []string) (string, error) {
+	if err := t.reserveOutbound(); err != nil {
+		return "", err
+	}
+	// The slot passes to the read loop once the handshake succeeds.
+	linked := false
+	defer func() {
+		if !linked {
+			t.release(nil, false)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(t.ctx, dialTimeout)
+	defer cancel()
+
+	conn, addr, err := t.dialAny(ctx, addrs)
+	if err != nil {
+		return "", err
+	}
+
+	dec := protocol.JSON.NewDecoder(conn)
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := protocol.JSON.NewEncoder(conn).Encode(t.hello("")); err != nil {
 		conn.Close()
-		return err
+		return "", err
 	}
-	
+	var reply protocol.Envelope
+	if err := dec.Decode(&reply); err != nil {
+		conn.Close()
+		return "", fmt.Errorf("handshake with %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch {
+	case reply.From == "" || reply.Type != protocol.TypePresence:
+		conn.Close()
+		return "", fmt.Errorf("handshake with %s: unexpected %s envelope", addr, reply.Type)
+	case reply.From == t.ID:
+		conn.Close()
+		return "", fmt.Errorf("handshake with %s: dialled ourselves", addr)
+	case peerID != "" && reply.From != peerID:
+		conn.Close()
+		return "", fmt.Errorf("handshake with %s: expected peer %s, got %s", addr, peerID, reply.From)
+	}
+	peerID = reply.From
+
+	codec := protocol.JSON
+	h, _ := protocol.ParseHello(reply)
+	if h.Codec != "" {
+		c, ok := protocol.CodecByName(h.Codec)
+		if !ok {
+			conn.Close()
+			return "", fmt.Errorf("handshake with %s: unknown codec %q", addr, h.Codec)
+		}
+		codec = c
+		dec = protocol.Switch(codec, dec, conn)
+	}
+
+	t.addrsLock.Lock()
+	t.addrs[peerID] = addrs
+	t.addrsLock.Unlock()
+
+	resend := t.deliveries.unacked(peerID)
+	p := t.addPeer(peerID, conn, codec, dec, h)
+	p.touch(reply.Nick)
+	p.setRooms(reply)
+	static := t.markStatic(addr, peerID)
+	t.emit(PeerEvent{Type: PeerUp, ID: peerID, Nick: reply.Nick, Addr: addr, Static: static, Clock: h.Clock})
+
+	linked = true
 	go t.handleConn(conn, dec, peerID)
-	
-	return nil
+	go t.retransmit(p, resend)
+
+	return peerID, nil
+}
+
+// redial tries to restore a dropped outbound link with exponential backoff,
+// giving up if the peer reconnects on its own or stays unreachable.
+func (t *Mesh) redial(peerID string) {
+	backoff := time.Second
+	for i := 0; i < maxRedials; i++ {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if t.peer(peerID) != nil {
+			return
+		}
+		// The address is looked up every round because Disconnect may have
+		// withdrawn it while we were waiting.
+		t.addrsLock.Lock()
+		addrs, ok := t.addrs[peerID]
+		t.addrsLock.Unlock()
+		if !ok {
+			return
+		}
+		if err := t.Dial(peerID, addrs...); err == nil {
+			return
+		}
+		backoff *= 2
+		if backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+}
+
+// hello builds our handshake: an offer of Codecs when dialling, or the
+// chosen codec when answering.
+func (t *Mesh) hello(codec string) protocol.Envelope {
+	h := protocol.Hello{Rooms: t.subscriptions(), Codec: codec}
+	if codec == "" {
+		h.Codecs = t.Codecs
+	}
+	if t.Compress {
+		h.Compress = []string{protocol.CompressDeflate}
+	}
+	if !t.Quiet {
+		h.Leave = leaveHash(t.leaveToken)
+	}
+	if t.Clock != nil {
+		h.Clock = t.Clock()
+	}
+	return protocol.NewHello(t.ID, t.Nick, h)
+}
+
+func (t *Mesh) control(c protocol.Control) protocol.Envelope {
+	return protocol.NewControl(t.nextID(), t.ID, t.Nick, c)
+}
+
+func (t *Mesh) nextID() string {
+	return fmt.Sprintf("%s-%d", t.ID, time.Now().UnixNano())
 }
 
-func (t *Transport) addPeer(id string, conn net.Conn, enc *json.Encoder, dec *json.Decoder) {
+// emit publishes ev without blocking; if nobody drains Events the oldest
+// news is simply lost rather than stalling connection handling.
+func (t *Mesh) emit(ev PeerEvent) {
+	select {
+	case t.eventCh <- ev:
+	default:
+	}
+}
+
+func (t *Mesh) addPeer(id string, conn net.Conn, codec protocol.Codec, dec protocol.Decoder, h protocol.Hello) *PeerConn {
 	t.peersLock.Lock()
 	defer t.peersLock.Unlock()
-	t.peers[id] = &PeerConn{
-		ID:   id,
-		Conn: conn,
-		Enc:  enc,
-		Dec:  dec,
+	p := &PeerConn{
+		ID:        id,
+		Conn:      conn,
+		Enc:       codec.NewEncoder(conn),
+		Dec:       dec,
+		Codec:     codec.Name(),
+		lastSeen:  time.Now(),
+		leaveHash: h.Leave,
+	}
+	if t.Compress && slices.Contains(h.Compress, protocol.CompressDeflate) {
+		p.zipMin = max(t.CompressMin, 1)
 	}
+	// Stop cancels before closing the connections it knows of, so one
+	// registered after that must be closed here.
+	if t.ctx.Err() != nil {
+		conn.Close()
+	}
+	t.peers[id] = p
+	return p
 }
 
-func (t *Transport) removePeer(id string) {
+func (t *Mesh) peer(id string) *PeerConn {
+	t.peersLock.RLock()
+	defer t.peersLock.RUnlock()
+	return t.peers[id]
+}
+
+// removePeer forgets id only if it is still bound to conn, so a stale
+// connection closing does not evict its replacement.
+func (t *Mesh) removePeer(id string, conn net.Conn) {
 	t.peersLock.Lock()
-	defer t.peersLock.Unlock()
+	p, ok := t.peers[id]
+	if !ok || p.Conn != conn {
+		t.peersLock.Unlock()
+		return
+	}
 	delete(t.peers, id)
+	t.peersLock.Unlock()
+
+	rooms := p.roomList()
+	p.mu.Lock()
+	nick, left := p.nick, p.left
+	p.mu.Unlock()
+	ev := PeerEvent{Type: PeerDown, ID: id, Nick: nick, Addr: conn.RemoteAddr().String(), Left: left}
+	if left {
+		ev.Rooms = rooms
+	}
+	t.emit(ev)
 }
 
-func (t *Transport) Broadcast(env protocol.Envelope) {
+func (t *Mesh) heartbeatLoop() {
+	ticker := time.NewTicker(t.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.peersLock.RLock()
+		peers := make([]*PeerConn, 0, len(t.peers))
+		for _, p := range t.peers {
+			peers = append(peers, p)
+		}
+		t.peersLock.RUnlock()
+
+		for _, p := range peers {
+			if time.Since(p.seen()) > t.IdleTimeout {
+				slog.Info("Closing idle connection", "peer", p.ID)
+				p.Conn.Close()
+				continue
+			}
+			go p.send(t.control(protocol.Control{Op: protocol.ControlPing, Sent: time.Now().UnixNano()}))
+		}
+	}
+}
+
+// Ping sends an immediate ping to peerID; the measured round trip shows up
+// in Peers once the pong arrives.
+func (t *Mesh) Ping(peerID string) error {
+	return t.Send(peerID, t.control(protocol.Control{Op: protocol.ControlPing, Sent: time.Now().UnixNano()}))
+}
+
+func (t *Mesh) Peers() []PeerInfo {
 	t.peersLock.RLock()
 	defer t.peersLock.RUnlock()
-	
+
+	infos := make([]PeerInfo, 0, len(t.peers))
 	for _, p := range t.peers {
-		go func(p *PeerConn) {
-			p.Enc.Encode(env)
-		}(p)
+		rooms := p.roomList()
+		p.mu.Lock()
+		infos = append(infos, PeerInfo{
+			ID:       p.ID,
+			Nick:     p.nick,
+			Addr:     p.Conn.RemoteAddr().String(),
+			RTT:      p.rtt,
+			LastSeen: p.lastSeen,
+			Rooms:    rooms,
+			Codec:    p.Codec,
+			Compress: p.zipMin > 0,
+		})
+		p.mu.Unlock()
 	}
+	return infos
 }
 
-func (t *Transport) Incoming() <-chan protocol.Envelope {
+// Send delivers env to a single connected peer.
+func (t *Mesh) Send(peerID string, env protocol.Envelope) error {
+	p := t.peer(peerID)
+	if p == nil {
+		return fmt.Errorf("peer %s not connected", peerID)
+	}
+	if env.Type == protocol.TypeChat && env.From == t.ID {
+		t.deliveries.track(env, []string{peerID})
+	}
+	return p.send(env)
+}
+
+// Broadcast sends env to every connected peer that wants it, except the one
+// it arrived from and its author, so forwarded envelopes are not echoed
+// back. Our own chat messages are tracked until each of those peers
+// acknowledges them.
+func (t *Mesh) Broadcast(env protocol.Envelope) {
+	t.peersLock.RLock()
+	defer t.peersLock.RUnlock()
+
+	targets := make([]*PeerConn, 0, len(t.peers))
+	for _, p := range t.peers {
+		if p.ID != env.Via && p.ID != env.From && p.wants(env) {
+			targets = append(targets, p)
+		}
+	}
+
+	if env.Type == protocol.TypeChat && env.From == t.ID {
+		ids := make([]string, 0, len(targets))
+		for _, p := range targets {
+			ids = append(ids, p.ID)
+		}
+		t.deliveries.track(env, ids)
+	}
+
+	// The envelope is compressed at most once and encoded once per codec
+	// and form in use, and each frame is shared by every writer rather
+	// than re-encoded for each peer.
+	type form struct {
+		codec string
+		zip   bool
+	}
+	frames := make(map[form][]byte, 2)
+	var zipped *protocol.Envelope
+	for _, p := range targets {
+		out := env
+		if p.zipMin > 0 && len(env.Payload) >= p.zipMin {
+			if zipped == nil {
+				z, _ := protocol.Deflate(env, 0)
+				zipped = &z
+			}
+			out = *zipped
+		}
+		key := form{p.Codec, out.Zip}
+		frame, ok := frames[key]
+		if !ok {
+			codec, _ := protocol.CodecByName(p.Codec)
+			var err error
+			if frame, err = codec.Marshal(out); err != nil {
+				slog.Error("Cannot encode broadcast", "id", env.ID, "err", err)
+				return
+			}
+			frames[key] = frame
+		}
+		go p.write(frame)
+	}
+}
+
+func (t *Mesh) Disconnect(peerID string) {
+	t.addrsLock.Lock()
+	delete(t.addrs, peerID)
+	t.addrsLock.Unlock()
+
+	if p := t.peer(peerID); p != nil {
+		p.Conn.Close()
+	}
+}
+
+// Delivery reports the acknowledgement state of one of our chat messages
+// among our direct neighbours (see DeliveryStatus). ok is false if the message is unknown or no longer tracked.
+func (t *Mesh) Delivery(id string) (status DeliveryStatus, ok bool) {
+	return t.deliveries.status(id)
+}
+
+func (t *Mesh) Incoming() <-chan protocol.Envelope {
 	return t.incomingCh
 }
 
-func (t *Transport) Stop() {
+func (t *Mesh) Events() <-chan PeerEvent {
+	return t.eventCh
+}
+
+func (t *Mesh) Acks() <-chan AckEvent {
+	return t.ackCh
+}
+
+// Stop tells every peer we are leaving, unless Quiet, then closes all
+// connections.
+func (t *Mesh) Stop() {
+	if t.ctx.Err() == nil && !t.Quiet {
+		t.sayGoodbye()
+	}
 	t.cancel()
 	if t.listener != nil {
 		t.listener.Close()
@@ -180,3 +800,44 @@ func (t *Transport) Stop() {
 		p.Conn.Close()
 	}
 }
+
+func (p *PeerConn) send(env protocol.Envelope) error {
+	env = p.compress(env)
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return p.Enc.Encode(env)
+}
+
+// compress deflates env's payload if the link compresses and the payload
+// is large enough to be worth it.
+func (p *PeerConn) compress(env protocol.Envelope) protocol.Envelope {
+	if p.zipMin > 0 {
+		env, _ = protocol.Deflate(env, p.zipMin)
+	}
+	return env
+}
+
+// write sends a pre-encoded frame in p's codec.
+func (p *PeerConn) write(frame []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := p.Conn.Write(frame)
+	return err
+}
+
+func (p *PeerConn) touch(nick string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSeen = time.Now()
+	if nick != "" {
+		p.nick = nick
+	}
+}
+
+func (p *PeerConn) seen() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSeen
+}
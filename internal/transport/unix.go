@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+type unixLink struct {
+	path string
+}
+
+// NewUnix returns a Mesh listening on a Unix domain socket at path, for
+// running several instances on one machine. Peers are dialled by socket path.
+func NewUnix(path, id, nick string) *Mesh {
+	return NewMesh(&unixLink{path: path}, id, nick)
+}
+
+func (l *unixLink) Listen() (net.Listener, error) {
+	if err := removeStaleSocket(l.path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", l.path)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+	return ln, nil
+}
+
+func (l *unixLink) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
+
+// removeStaleSocket deletes a socket file left behind by a crashed instance,
+// refusing to touch one that still accepts connections.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return &net.OpError{Op: "listen", Net: "unix", Err: errors.New("path exists and is not a socket")}
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return &net.OpError{Op: "listen", Net: "unix", Err: errors.New("socket is in use")}
+	}
+	return os.Remove(path)
+}
@@ -3,11 +3,16 @@ package tui
 import (
 	"ephemeral/internal/config"
 	"ephemeral/internal/discovery"
+	"ephemeral/internal/node"
 	"ephemeral/internal/protocol"
 	"ephemeral/internal/room"
+	"ephemeral/internal/transfer"
 	"ephemeral/internal/transport"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -85,13 +90,16 @@ var (
 			Padding(0, 1)
 )
 
-var availableCommands = []string{"/join", "/nick", "/clear", "/help", "/ip"}
+var availableCommands = []string{"/join", "/leave", "/nick", "/clear", "/help", "/ip", "/ping", "/connect", "/send", "/accept", "/reject"}
 
 type model struct {
 	cfg       *config.Config
+	node      *node.Node
+	events    <-chan node.Event
 	roomMgr   *room.Manager
-	transport *transport.Transport
+	transport transport.Transport
 	discovery *discovery.Service
+	transfers *transfer.Manager
 
 	viewport  viewport.Model
 	textInput textinput.Model
@@ -105,7 +113,7 @@ type model struct {
 	ready  bool
 }
 
-func InitialModel(cfg *config.Config, rm *room.Manager, tr *transport.Transport, disc *discovery.Service) model {
+func InitialModel(cfg *config.Config, n *node.Node) model {
 	ti := textinput.New()
 	ti.Placeholder = "Type a message..."
 	ti.Focus()
@@ -113,11 +121,16 @@ func InitialModel(cfg *config.Config, rm *room.Manager, tr *transport.Transport,
 	ti.PromptStyle = lipgloss.NewStyle().Foreground(accentGreen)
 	ti.CharLimit = 1000
 
+	// The subscription lasts as long as the program.
+	events, _ := n.Subscribe()
 	return model{
 		cfg:       cfg,
-		roomMgr:   rm,
-		transport: tr,
-		discovery: disc,
+		node:      n,
+		events:    events,
+		roomMgr:   n.Rooms,
+		transport: n.Transport,
+		discovery: n.Discovery,
+		transfers: n.Transfers,
 		textInput: ti,
 	}
 }
@@ -125,8 +138,9 @@ func InitialModel(cfg *config.Config, rm *room.Manager, tr *transport.Transport,
 func (m model) Init() tea.Cmd {
 	return tea.Batch(
 		textinput.Blink,
-		waitForMessage(m.transport.Incoming()),
-		waitForPeer(m.discovery.Peers()),
+		waitForEvent(m.events),
+		waitForAck(m.transport.Acks()),
+		waitForTransfer(m.transfers.Events()),
 	)
 }
 
@@ -175,7 +189,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.textInput.SetValue("")
 			}
 		case tea.KeyCtrlL:
-			m.roomMgr.Current().Messages = nil
+			m.roomMgr.ClearMessages(m.roomMgr.CurrentName())
 			m.viewport.SetContent(m.renderMessages())
 		}
 
@@ -196,15 +210,20 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.height = msg.Height
 		m.viewport.SetContent(m.renderMessages())
 
-	case protocol.Envelope:
-		m.roomMgr.AddMessage(msg)
+	case node.Event:
 		m.viewport.SetContent(m.renderMessages())
-		m.viewport.GotoBottom()
-		cmds = append(cmds, waitForMessage(m.transport.Incoming()))
+		if msg.Kind == node.Message && msg.Message.Room == m.roomMgr.CurrentName() {
+			m.viewport.GotoBottom()
+		}
+		cmds = append(cmds, waitForEvent(m.events))
 
-	case discovery.Peer:
-		go m.transport.Connect(msg.ID, msg.IP.String(), msg.Port)
-		cmds = append(cmds, waitForPeer(m.discovery.Peers()))
+	case transport.AckEvent:
+		m.viewport.SetContent(m.renderMessages())
+		cmds = append(cmds, waitForAck(m.transport.Acks()))
+
+	case transfer.Event:
+		m.transferEvent(msg)
+		cmds = append(cmds, waitForTransfer(m.transfers.Events()))
 	}
 
 	m.textInput, tiCmd = m.textInput.Update(msg)
@@ -300,7 +319,23 @@ func (m model) renderFooter() string {
 	ctrlL := keycapStyle.Render("CTRL+L") + keycapDescStyle.Render("Clear")
 	tab := keycapStyle.Render("TAB") + keycapDescStyle.Render("Autocomplete")
 
-	return lipgloss.JoinHorizontal(lipgloss.Top, esc, ctrlL, tab)
+	keys := lipgloss.JoinHorizontal(lipgloss.Top, esc, ctrlL, tab)
+	if active := m.transfers.Active(); len(active) > 0 {
+		var parts []string
+		for _, s := range active {
+			arrow := "↑"
+			if s.Incoming {
+				arrow = "↓"
+			}
+			pct := int64(100)
+			if s.Size > 0 {
+				pct = s.Bytes * 100 / s.Size
+			}
+			parts = append(parts, fmt.Sprintf("%s %s %d%%", arrow, s.Name, pct))
+		}
+		keys = lipgloss.JoinHorizontal(lipgloss.Top, keys, statusStyle.Render(strings.Join(parts, "  ")))
+	}
+	return keys
 }
 
 func (m *model) sendMessage(text string) {
@@ -310,54 +345,212 @@ func (m *model) sendMessage(text string) {
 		switch cmd {
 		case "/join":
 			if len(parts) > 1 {
-				m.roomMgr.Join(parts[1], false, nil)
+				password := ""
+				if len(parts) > 2 {
+					password = parts[2]
+				}
+				if err := m.node.Join(parts[1], password); err != nil {
+					m.systemMessage(err.Error())
+					return
+				}
+				m.roomMgr.Switch(parts[1])
+				m.viewport.SetContent(m.renderMessages())
+			}
+		case "/leave":
+			name := m.roomMgr.CurrentName()
+			if len(parts) > 1 {
+				name = parts[1]
+			}
+			if m.node.Leave(name) {
+				m.viewport.SetContent(m.renderMessages())
+			} else if name == "global" {
+				m.systemMessage("The global room cannot be left")
+			} else {
+				m.systemMessage(fmt.Sprintf("You are not in %s", name))
 			}
 		case "/nick":
 			if len(parts) > 1 {
-				m.roomMgr.Nick = parts[1]
+				m.roomMgr.SetNick(parts[1])
 			}
 		case "/clear":
-			m.roomMgr.Current().Messages = nil
+			m.roomMgr.ClearMessages(m.roomMgr.CurrentName())
 			m.viewport.SetContent(m.renderMessages())
 		case "/help":
-			m.roomMgr.AddMessage(protocol.NewEnvelope("sys", "system", "System", m.roomMgr.CurrentRoom, protocol.TypeChat, "Available commands: /join <room>, /nick <name>, /clear, /help, /ip"))
-			m.viewport.SetContent(m.renderMessages())
-			m.viewport.GotoBottom()
+			m.systemMessage("Available commands: /join <room> [password], /leave [room], /nick <name>, /clear, /help, /ip, /ping [nick], /connect <host:port>, /send <nick> <path>, /accept <id> [dir], /reject <id>")
 		case "/ip":
-			addrs, _ := net.InterfaceAddrs()
-			var ip string
-			for _, a := range addrs {
-				if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-					if ipnet.IP.To4() != nil {
-						ip = ipnet.IP.String()
-						break
-					}
+			var addrs []string
+			for _, a := range m.discovery.Scope.Addrs() {
+				addrs = append(addrs, net.JoinHostPort(a.String(), strconv.Itoa(m.discovery.Port)))
+			}
+			if len(addrs) == 0 {
+				m.systemMessage("No usable network address")
+			} else {
+				m.systemMessage(fmt.Sprintf("Reachable on: %s", strings.Join(addrs, ", ")))
+			}
+		case "/ping":
+			m.ping(parts[1:])
+		case "/send":
+			// The path is everything after the nick, spaces included.
+			args := strings.SplitN(text, " ", 3)
+			if len(args) < 3 || strings.TrimSpace(args[2]) == "" {
+				m.systemMessage("Usage: /send <nick> <path>")
+			} else {
+				m.sendFile(args[1], expandHome(strings.TrimSpace(args[2])))
+			}
+		case "/accept":
+			if len(parts) < 2 {
+				m.systemMessage("Usage: /accept <id> [directory]")
+			} else {
+				dir := ""
+				if len(parts) > 2 {
+					dir = expandHome(strings.TrimSpace(strings.SplitN(text, " ", 3)[2]))
+				}
+				if err := m.transfers.Accept(parts[1], dir); err != nil {
+					m.systemMessage(fmt.Sprintf("Cannot accept %s: %v", parts[1], err))
 				}
 			}
-			m.roomMgr.AddMessage(protocol.NewEnvelope("sys", "system", "System", m.roomMgr.CurrentRoom, protocol.TypeChat, fmt.Sprintf("Your Local IP: %s", ip)))
-			m.viewport.SetContent(m.renderMessages())
-			m.viewport.GotoBottom()
+		case "/reject":
+			if len(parts) < 2 {
+				m.systemMessage("Usage: /reject <id>")
+			} else if err := m.transfers.Reject(parts[1]); err != nil {
+				m.systemMessage(fmt.Sprintf("Cannot reject %s: %v", parts[1], err))
+			}
+		case "/connect":
+			if len(parts) < 2 {
+				m.systemMessage("Usage: /connect <host:port>")
+			} else if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+				m.systemMessage(fmt.Sprintf("Invalid address %s: %v", parts[1], err))
+			} else {
+				m.transport.Persist(parts[1])
+				m.systemMessage(fmt.Sprintf("Connecting to %s", parts[1]))
+			}
 		}
 		return
 	}
 
-	env := protocol.NewEnvelope(
-		fmt.Sprintf("%s-%d", m.roomMgr.PeerID, time.Now().UnixNano()),
-		m.roomMgr.PeerID,
-		m.roomMgr.Nick,
-		m.roomMgr.CurrentRoom,
-		protocol.TypeChat,
-		text,
-	)
+	if _, err := m.node.Say(m.roomMgr.CurrentName(), text); err != nil {
+		m.systemMessage(fmt.Sprintf("Message not sent: %v", err))
+		return
+	}
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.GotoBottom()
+}
+
+// sendFile offers path to the connected peer called nick. Offers made from
+// an encrypted room are sealed with its key, so the peer must be a member.
+func (m *model) sendFile(nick, path string) {
+	for _, p := range m.transport.Peers() {
+		if !strings.EqualFold(p.Nick, nick) {
+			continue
+		}
+		if _, err := m.transfers.Offer(p.ID, p.Nick, path, m.roomMgr.CurrentName()); err != nil {
+			m.systemMessage(fmt.Sprintf("Cannot send %s: %v", path, err))
+		} else {
+			m.systemMessage(fmt.Sprintf("Offered %s to %s", filepath.Base(path), p.Nick))
+		}
+		return
+	}
+	m.systemMessage(fmt.Sprintf("No connected peer named %s", nick))
+}
+
+func (m *model) transferEvent(ev transfer.Event) {
+	switch ev.Kind {
+	case transfer.Offered:
+		m.systemMessage(fmt.Sprintf("%s offers %s (%s): /accept %s [dir] or /reject %s", ev.Nick, ev.Name, humanSize(ev.Size), ev.ID, ev.ID))
+	case transfer.Done:
+		if ev.Incoming {
+			m.systemMessage(fmt.Sprintf("Received %s from %s into %s (SHA-256 verified)", ev.Name, ev.Nick, ev.Path))
+		} else {
+			m.systemMessage(fmt.Sprintf("%s received %s", ev.Nick, ev.Name))
+		}
+	case transfer.Failed:
+		m.systemMessage(fmt.Sprintf("Transfer of %s failed: %v", ev.Name, ev.Err))
+	case transfer.Rejected:
+		m.systemMessage(fmt.Sprintf("%s did not take %s", ev.Nick, ev.Name))
+	}
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// ping reports the last measured round trip to every peer matching nicks
+// (or all peers) and fires a fresh ping so the next /ping is up to date.
+func (m *model) ping(nicks []string) {
+	var lines []string
+	for _, p := range m.transport.Peers() {
+		if len(nicks) > 0 && !containsFold(nicks, p.Nick) {
+			continue
+		}
+		m.transport.Ping(p.ID)
+		name := p.Nick
+		if name == "" {
+			name = p.ID
+		}
+		if p.RTT > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, p.RTT.Round(100*time.Microsecond)))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: measuring...", name))
+		}
+	}
+	if len(lines) == 0 {
+		if len(nicks) > 0 {
+			m.systemMessage(fmt.Sprintf("No connected peer named %s", strings.Join(nicks, ", ")))
+		} else {
+			m.systemMessage("No connected peers")
+		}
+		return
+	}
+	m.systemMessage("Ping " + strings.Join(lines, " | "))
+}
 
-	m.roomMgr.AddMessage(env)
+func (m *model) systemMessage(text string) {
+	m.notice(m.roomMgr.CurrentName(), text)
 	m.viewport.SetContent(m.renderMessages())
 	m.viewport.GotoBottom()
-	m.transport.Broadcast(env)
+}
+
+// notice adds a system line to roomName without redrawing.
+func (m *model) notice(roomName, text string) {
+	m.roomMgr.AddMessage(protocol.NewEnvelope(
+		fmt.Sprintf("sys-%d", time.Now().UnixNano()),
+		"system",
+		"System",
+		roomName,
+		protocol.TypeChat,
+		text,
+	))
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *model) renderMessages() string {
-	msgs := m.roomMgr.GetMessages(m.roomMgr.CurrentRoom)
+	msgs := m.roomMgr.GetMessages(m.roomMgr.CurrentName())
 	var b strings.Builder
 	for _, msg := range msgs {
 		t := time.Unix(msg.TS, 0).Format("15:04")
@@ -365,7 +558,7 @@ func (m *model) renderMessages() string {
 
 		if msg.From == m.roomMgr.PeerID {
 			nick := myMsgStyle.Render("You")
-			line := fmt.Sprintf("%s %s: %s", ts, nick, msg.Payload)
+			line := fmt.Sprintf("%s %s: %s%s", ts, nick, msg.Payload, m.deliveryMarker(msg.ID))
 			// Right align local messages
 			padding := m.width - lipgloss.Width(line) - 4
 			if padding > 0 {
@@ -380,13 +573,32 @@ func (m *model) renderMessages() string {
 	return b.String()
 }
 
-func waitForMessage(ch <-chan protocol.Envelope) tea.Cmd {
+// deliveryMarker renders a check once every neighbour we handed one of our
+// messages to acknowledged it and an ellipsis while some are still pending.
+func (m *model) deliveryMarker(id string) string {
+	st, ok := m.transport.Delivery(id)
+	if !ok || st.Acked+st.Pending == 0 {
+		return ""
+	}
+	if st.Pending > 0 {
+		return " " + systemStyle.Render("…")
+	}
+	return " " + systemStyle.Render("✓")
+}
+
+func waitForAck(ch <-chan transport.AckEvent) tea.Cmd {
+	return func() tea.Msg {
+		return <-ch
+	}
+}
+
+func waitForTransfer(ch <-chan transfer.Event) tea.Cmd {
 	return func() tea.Msg {
 		return <-ch
 	}
 }
 
-func waitForPeer(ch <-chan discovery.Peer) tea.Cmd {
+func waitForEvent(ch <-chan node.Event) tea.Cmd {
 	return func() tea.Msg {
 		return <-ch
 	}
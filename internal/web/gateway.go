@@ -0,0 +1,231 @@
+package web
+
+import (
+	"ephemeral/internal/node"
+	"ephemeral/internal/protocol"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Page is the chat client the gateway serves at its root.
+const Page = "/pages/live.html"
+
+// maxText bounds a message typed in the browser.
+const maxText = 4096
+
+// frame is the JSON exchanged with the browser over the WebSocket.
+//
+// The browser sends join (Room, Password), leave (Room) and say (Room,
+// Text). The gateway sends welcome (Nick, Rooms, Peers) on connect, history
+// (Room, Messages) for every room the browser can see, message for each
+// new chat line, rooms and peers when those lists change, and error.
+type frame struct {
+	Op       string   `json:"op"`
+	Room     string   `json:"room,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Text     string   `json:"text,omitempty"`
+	Nick     string   `json:"nick,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	TS       int64    `json:"ts,omitempty"`
+	Self     bool     `json:"self,omitempty"`
+	System   bool     `json:"system,omitempty"`
+	Rooms    []string `json:"rooms,omitempty"`
+	Peers    []string `json:"peers,omitempty"`
+	Messages []frame  `json:"messages,omitempty"`
+}
+
+// Gateway serves the bundled web client and bridges its WebSocket to a
+// node, so a browser on the same machine chats as that node. Every open
+// tab shares the node's nick and rooms.
+type Gateway struct {
+	node   *node.Node
+	mux    *http.ServeMux
+	assets http.Handler
+}
+
+func New(n *node.Node, assets fs.FS) *Gateway {
+	g := &Gateway{node: n, mux: http.NewServeMux(), assets: http.FileServerFS(assets)}
+	g.mux.Handle("/ws", websocket.Server{Handshake: checkOrigin, Handler: g.serveWS})
+	g.mux.HandleFunc("/", g.serveAssets)
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+func (g *Gateway) serveAssets(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		http.Redirect(w, r, Page, http.StatusFound)
+		return
+	}
+	g.assets.ServeHTTP(w, r)
+}
+
+// checkOrigin only lets pages served from a loopback host open the
+// socket. Any site the user visits could otherwise script a WebSocket to
+// localhost and chat as them; checking Host as well defeats DNS
+// rebinding, where the attacker's name resolves to 127.0.0.1.
+func checkOrigin(cfg *websocket.Config, r *http.Request) error {
+	if !IsLoopback(r.Host) {
+		return fmt.Errorf("host %q is not a loopback address", r.Host)
+	}
+	origin, err := websocket.Origin(cfg, r)
+	if err != nil || origin == nil {
+		return errors.New("missing origin")
+	}
+	if origin.Host != r.Host {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return nil
+}
+
+// IsLoopback reports whether hostport names this machine: localhost or a
+// loopback IP, with or without a port.
+func IsLoopback(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type client struct {
+	g    *Gateway
+	ws   *websocket.Conn
+	wmu  sync.Mutex
+	self string
+}
+
+func (g *Gateway) serveWS(ws *websocket.Conn) {
+	ws.MaxPayloadBytes = 64 << 10
+	c := &client{g: g, ws: ws, self: g.node.Rooms.PeerID}
+
+	events, cancel := g.node.Subscribe()
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go c.forward(events, done)
+
+	c.send(frame{Op: "welcome", Nick: g.node.Rooms.Nick(), Rooms: g.node.Rooms.Names(), Peers: g.peers()})
+	for _, name := range g.node.Rooms.Names() {
+		c.history(name)
+	}
+
+	for {
+		var f frame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			return
+		}
+		c.handle(f)
+	}
+}
+
+func (c *client) handle(f frame) {
+	n := c.g.node
+	switch f.Op {
+	case "join":
+		if err := n.Join(f.Room, f.Password); err != nil {
+			c.fail(err)
+			return
+		}
+		c.history(f.Room)
+	case "leave":
+		if !n.Leave(f.Room) {
+			c.fail(fmt.Errorf("cannot leave %s", f.Room))
+		}
+	case "say":
+		text := strings.TrimSpace(f.Text)
+		switch {
+		case text == "":
+		case len(text) > maxText:
+			c.fail(fmt.Errorf("message longer than %d bytes", maxText))
+		default:
+			if _, err := n.Say(f.Room, text); err != nil {
+				c.fail(fmt.Errorf("message not sent: %w", err))
+			}
+		}
+	default:
+		c.fail(fmt.Errorf("unknown op %q", f.Op))
+	}
+}
+
+// forward relays node events to the browser until the socket closes.
+func (c *client) forward(events <-chan node.Event, done <-chan struct{}) {
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			switch ev.Kind {
+			case node.Message:
+				m := c.message(ev.Message)
+				m.Op = "message"
+				c.send(m)
+			case node.PeerUp, node.PeerDown:
+				c.send(frame{Op: "peers", Peers: c.g.peers()})
+			case node.RoomsChanged:
+				c.send(frame{Op: "rooms", Rooms: c.g.node.Rooms.Names()})
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *client) history(roomName string) {
+	msgs := c.g.node.Rooms.GetMessages(roomName)
+	h := frame{Op: "history", Room: roomName, Messages: make([]frame, 0, len(msgs))}
+	for _, env := range msgs {
+		h.Messages = append(h.Messages, c.message(env))
+	}
+	c.send(h)
+}
+
+func (c *client) message(env protocol.Envelope) frame {
+	return frame{
+		Room:   env.Room,
+		ID:     env.ID,
+		Nick:   env.Nick,
+		Text:   env.Payload,
+		TS:     env.TS,
+		Self:   env.From == c.self,
+		System: env.From == "system",
+	}
+}
+
+func (c *client) fail(err error) {
+	c.send(frame{Op: "error", Text: err.Error()})
+}
+
+func (c *client) send(f frame) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	websocket.JSON.Send(c.ws, f)
+}
+
+// peers lists the nicks of connected peers in alphabetical order.
+func (g *Gateway) peers() []string {
+	var nicks []string
+	for _, p := range g.node.Transport.Peers() {
+		if p.Nick != "" {
+			nicks = append(nicks, p.Nick)
+		}
+	}
+	sort.Strings(nicks)
+	return nicks
+}
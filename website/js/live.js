@@ -0,0 +1,132 @@
+// Browser client for `ephemeral web`: talks JSON frames over /ws to the
+// local node, which does the actual chatting.
+document.addEventListener('DOMContentLoaded', () => {
+    const $ = (id) => document.getElementById(id);
+    const rooms = new Map(); // room name -> messages
+    let current = 'global';
+    let nick = '';
+    let ws;
+
+    const time = (ts) => new Date(ts * 1000).toTimeString().slice(0, 5);
+
+    const line = (m) => {
+        const div = document.createElement('div');
+        div.className = 'live-line' + (m.self ? ' self' : '') + (m.system ? ' system' : '');
+        const ts = document.createElement('span');
+        ts.className = 'live-ts';
+        ts.textContent = time(m.ts);
+        const who = document.createElement('span');
+        who.className = 'live-nick';
+        who.textContent = m.self ? 'You' : m.nick;
+        const text = document.createElement('span');
+        text.textContent = m.text;
+        div.append(ts, ' ', who, ': ', text);
+        return div;
+    };
+
+    const renderMessages = () => {
+        const box = $('messages');
+        box.replaceChildren(...(rooms.get(current) || []).map(line));
+        box.scrollTop = box.scrollHeight;
+        $('room-title').textContent = '#' + current;
+        $('leave').hidden = current === 'global';
+    };
+
+    const renderList = (el, items, onClick) => {
+        el.replaceChildren(...items.map((name) => {
+            const li = document.createElement('li');
+            li.textContent = name;
+            if (onClick) {
+                li.className = name === current ? 'active' : '';
+                li.addEventListener('click', () => onClick(name));
+            }
+            return li;
+        }));
+    };
+
+    const renderRooms = () => renderList($('rooms'), [...rooms.keys()].sort(), (name) => {
+        current = name;
+        renderRooms();
+        renderMessages();
+    });
+
+    const setRooms = (names) => {
+        for (const name of names) {
+            if (!rooms.has(name)) rooms.set(name, []);
+        }
+        for (const name of [...rooms.keys()]) {
+            if (!names.includes(name)) rooms.delete(name);
+        }
+        if (!rooms.has(current)) current = 'global';
+        renderRooms();
+        renderMessages();
+    };
+
+    const status = (text) => { $('status').textContent = text; };
+
+    const handle = (f) => {
+        switch (f.op) {
+        case 'welcome':
+            nick = f.nick;
+            status('connected as ' + nick);
+            setRooms(f.rooms || []);
+            renderList($('peers'), f.peers || []);
+            break;
+        case 'history':
+            rooms.set(f.room, f.messages || []);
+            if (f.room === current) renderMessages();
+            break;
+        case 'message': {
+            const msgs = rooms.get(f.room);
+            if (!msgs || msgs.some((m) => m.id === f.id)) break;
+            msgs.push(f);
+            if (f.room === current) renderMessages();
+            break;
+        }
+        case 'rooms':
+            setRooms(f.rooms || []);
+            break;
+        case 'peers':
+            renderList($('peers'), f.peers || []);
+            break;
+        case 'error':
+            (rooms.get(current) || []).push({ system: true, nick: 'System', text: f.text, ts: Date.now() / 1000 });
+            renderMessages();
+            break;
+        }
+    };
+
+    const connect = () => {
+        ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws');
+        ws.onmessage = (e) => handle(JSON.parse(e.data));
+        ws.onclose = () => {
+            status('disconnected, retrying...');
+            setTimeout(connect, 2000);
+        };
+    };
+
+    const send = (f) => {
+        if (ws && ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify(f));
+    };
+
+    $('say').addEventListener('submit', (e) => {
+        e.preventDefault();
+        const text = $('text').value.trim();
+        if (text) send({ op: 'say', room: current, text });
+        $('text').value = '';
+    });
+
+    $('join').addEventListener('submit', (e) => {
+        e.preventDefault();
+        const room = $('join-room').value.trim();
+        if (!room) return;
+        send({ op: 'join', room, password: $('join-password').value });
+        current = room;
+        $('join-room').value = '';
+        $('join-password').value = '';
+    });
+
+    $('leave').addEventListener('click', () => send({ op: 'leave', room: current }));
+
+    connect();
+});
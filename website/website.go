@@ -0,0 +1,8 @@
+// Package website embeds the static site so the web gateway can serve it
+// without a checkout of the repository.
+package website
+
+import "embed"
+
+//go:embed css js pages
+var FS embed.FS